@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type registry struct {
+	mu      sync.RWMutex
+	devices map[int]*Database
+}
+
+func newRegistry() *registry {
+	return &registry{devices: make(map[int]*Database)}
+}
+
+// clone copies dev together with its slices, which the hub goes on writing
+// under the registry lock while the API encodes the copy.
+func (dev *Database) clone() Database {
+	cp := *dev
+	cp.ConnDevs = append([]string(nil), dev.ConnDevs...)
+	cp.Triggers = append([]Trigger(nil), dev.Triggers...)
+	cp.Downtimes = append([]Downtime(nil), dev.Downtimes...)
+	return cp
+}
+
+func (reg *registry) snapshot() []Database {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	devices := make([]Database, 0, len(reg.devices))
+	for _, dev := range reg.devices {
+		devices = append(devices, dev.clone())
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Address < devices[j].Address
+	})
+	return devices
+}
+
+func (reg *registry) device(address int) (Database, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	dev, ok := reg.devices[address]
+	if !ok {
+		return Database{}, false
+	}
+	return dev.clone(), true
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// newAPI serves the device registry:
+//
+//	GET /devices
+//	GET /devices/{address}
+//	GET /devices/{address}/readings
+//	GET /devices/{address}/history?sensor=temperature&from=0&to=86400000&step=60000
+//	GET /devices/{address}/rules
+//	POST /devices/{address}/state {"state": 1}
+//	GET /commands/{id}
+//	GET /overrides
+//	GET, PUT, DELETE /overrides/{name}
+//	GET /groups
+//	POST /groups/{name}/on, /groups/{name}/off
+//	GET /scenes
+//	POST /scenes/{name}/activate
+//	GET /metrics
+//	GET /healthz
+//	GET /readyz
+//	GET /events?since=0
+func newAPI(h *hub) *http.ServeMux {
+	reg, history, overrides, scenes, health := h.reg, h.history, h.overrides, h.scenes, h.health
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	mux.HandleFunc("/healthz", health.healthz)
+	mux.HandleFunc("/readyz", health.readyz)
+	mux.HandleFunc("/devices", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, reg.snapshot())
+	})
+	mux.HandleFunc("/devices/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/devices/"), "/")
+		address, err := strconv.ParseInt(parts[0], 16, 64)
+		if err != nil {
+			http.Error(w, "bad device address", http.StatusBadRequest)
+			return
+		}
+		dev, ok := reg.device(int(address))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if len(parts) == 2 && parts[1] == "state" {
+			serveSetState(w, r, h.commands, dev)
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		switch {
+		case len(parts) == 1:
+			writeJSON(w, http.StatusOK, dev)
+		case len(parts) == 2 && parts[1] == "readings" && dev.DevType == EnvSensor:
+			writeJSON(w, http.StatusOK, dev.Readings)
+		case len(parts) == 2 && parts[1] == "history" && dev.DevType == EnvSensor:
+			serveHistory(w, r, history, dev.Address)
+		case len(parts) == 2 && parts[1] == "rules":
+			writeJSON(w, http.StatusOK, overrides.rules(dev))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	mux.HandleFunc("/overrides", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, overrides.all())
+	})
+	mux.HandleFunc("/overrides/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/overrides/")
+		if name == "" {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			ovr, ok := overrides.get(name)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			writeJSON(w, http.StatusOK, ovr)
+		case http.MethodPut:
+			var ovr DeviceOverride
+			if err := json.NewDecoder(r.Body).Decode(&ovr); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := overrides.set(name, ovr); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, http.StatusOK, ovr)
+		case http.MethodDelete:
+			if err := overrides.remove(name); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/groups", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, scenes.groups)
+	})
+	mux.HandleFunc("/groups/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/groups/"), "/")
+		if len(parts) != 2 || (parts[1] != "on" && parts[1] != "off") {
+			http.NotFound(w, r)
+			return
+		}
+		var state byte
+		if parts[1] == "on" {
+			state = 1
+		}
+		if !scenes.activateGroup(parts[0], state) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/scenes", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, scenes.scenes)
+	})
+	mux.HandleFunc("/scenes/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/scenes/"), "/")
+		if len(parts) != 2 || parts[1] != "activate" {
+			http.NotFound(w, r)
+			return
+		}
+		if !scenes.activateScene(parts[0]) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("/commands/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/commands/"))
+		if err != nil {
+			http.Error(w, "bad command id", http.StatusBadRequest)
+			return
+		}
+		cmd, ok := h.commands.get(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, cmd)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		since := 0
+		if query := r.URL.Query().Get("since"); query != "" {
+			value, err := strconv.Atoi(query)
+			if err != nil {
+				http.Error(w, "bad since", http.StatusBadRequest)
+				return
+			}
+			since = value
+		}
+		writeJSON(w, http.StatusOK, h.events.since(since))
+	})
+	return mux
+}
+
+func serveHistory(w http.ResponseWriter, r *http.Request, history *historyStore, address int) {
+	query := r.URL.Query()
+	sensor, ok := sensorNames[query.Get("sensor")]
+	if !ok {
+		http.Error(w, "unknown sensor", http.StatusBadRequest)
+		return
+	}
+	bounds := map[string]int{"from": 0, "to": math.MaxInt, "step": 0}
+	for name := range bounds {
+		if query.Get(name) == "" {
+			continue
+		}
+		value, err := strconv.Atoi(query.Get(name))
+		if err != nil {
+			http.Error(w, "bad "+name, http.StatusBadRequest)
+			return
+		}
+		bounds[name] = value
+	}
+	writeJSON(w, http.StatusOK, history.History(address, sensor, bounds["from"], bounds["to"], bounds["step"]))
+}
+
+func serveSetState(w http.ResponseWriter, r *http.Request, commands *commandTracker, dev Database) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if dev.DevType != Lamp && dev.DevType != Socket {
+		http.Error(w, "device has no settable state", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		State byte `json:"state"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.State > 1 {
+		http.Error(w, "state must be 0 or 1", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, commands.request(dev.Address, body.State))
+}
+
+// serveAPI binds addr before returning, so a taken port or a bad address
+// fails startup, and serves the API in the background.
+func serveAPI(addr string, h *hub) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		log.Print(http.Serve(ln, newAPI(h)))
+	}()
+	return nil
+}
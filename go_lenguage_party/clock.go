@@ -0,0 +1,89 @@
+package main
+
+import "time"
+
+// NetworkClock is the hub's view of network time in milliseconds, Clock
+// being the devType that drives it. Observe moves it on with a received
+// batch and returns the new time together with how far it jumped without
+// that time having passed, which the hub shifts its pending timeouts by.
+type NetworkClock interface {
+	Now() int
+	Observe(pcts Packets) (int, int)
+}
+
+// tickClock follows the Clock device's TICKs. A batch without a TICK moves
+// it on by the monotonic time since the previous batch, so timeouts keep
+// running while the clock is silent. The first TICK and any TICK going
+// backwards are jumps, the time passed since the last batch is the
+// monotonic one.
+type tickClock struct {
+	mono   func() time.Duration
+	now    int
+	seen   time.Duration
+	ticked bool
+}
+
+func newTickClock(mono func() time.Duration) *tickClock {
+	return &tickClock{mono: mono, seen: mono()}
+}
+
+func monotonicSince(start time.Time) func() time.Duration {
+	return func() time.Duration {
+		return time.Since(start)
+	}
+}
+
+func (tc *tickClock) Now() int {
+	return tc.now
+}
+
+func (tc *tickClock) Observe(pcts Packets) (int, int) {
+	seen := tc.mono()
+	elapsed := tc.now + int((seen - tc.seen).Milliseconds())
+	tc.seen = seen
+	tick := findTime(pcts)
+	if tick < 0 {
+		tc.now = elapsed
+		return tc.now, 0
+	}
+	shift := 0
+	if !tc.ticked || tick < tc.now {
+		shift = tick - elapsed
+	}
+	tc.ticked = true
+	tc.now = tick
+	return tc.now, shift
+}
+
+// observe moves hub time on with pcts. When the clock jumps everything
+// timed on hub time moves with it: pending requests and commands, scheduled
+// polls and probes, dwells and scene schedules. They keep the age they
+// really have instead of all expiring or firing at once, or stalling until
+// the clock catches up again.
+func (h *hub) observe(pcts Packets) {
+	now, shift := h.clock.Observe(pcts)
+	h.hubTime = now
+	if shift == 0 {
+		return
+	}
+	for _, times := range h.requestTime {
+		for i := range times {
+			times[i] += shift
+		}
+	}
+	h.lastWhois += shift
+	h.commands.rebase(shift)
+	h.scenes.rebase(shift)
+	h.scheduler.rebase(shift)
+	h.recovery.rebase(shift)
+	h.engine.rebase(shift)
+}
+
+// batchTime is the TICK of pcts, or the clock's time for a batch without
+// one.
+func (h *hub) batchTime(pcts Packets) int {
+	if tick := findTime(pcts); tick >= 0 {
+		return tick
+	}
+	return h.clock.Now()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock only moves on TICKs and Advance.
+type fakeClock struct {
+	now int
+}
+
+func (fc *fakeClock) Now() int {
+	return fc.now
+}
+
+func (fc *fakeClock) Observe(pcts Packets) (int, int) {
+	if tick := findTime(pcts); tick >= 0 {
+		fc.now = tick
+	}
+	return fc.now, 0
+}
+
+func (fc *fakeClock) Advance(ms int) {
+	fc.now += ms
+}
+
+func TestTickClock(t *testing.T) {
+	mono := time.Duration(0)
+	tc := newTickClock(func() time.Duration { return mono })
+	tick := func(ts int) Packets {
+		return Packets{devicePacket(6, OpenProtocol, ts, Clock, TICK, Timestamp{Timestamp: ts})}
+	}
+
+	observe := func(pcts Packets) [2]int {
+		now, shift := tc.Observe(pcts)
+		return [2]int{now, shift}
+	}
+
+	mono = 50 * time.Millisecond
+	assert.Equal(t, [2]int{50, 0}, observe(Packets{}))
+	// the first TICK switches from monotonic to network time
+	mono = 80 * time.Millisecond
+	assert.Equal(t, [2]int{1000, 920}, observe(tick(1000)))
+	mono = 230 * time.Millisecond
+	assert.Equal(t, [2]int{1150, 0}, observe(Packets{devicePacket(4, 1, 1, Lamp, STATUS, Value{Value: 1})}))
+	assert.Equal(t, 1150, tc.Now())
+	mono = 240 * time.Millisecond
+	assert.Equal(t, [2]int{1100, -60}, observe(tick(1100)))
+	// later TICKs are network time passing
+	mono = 250 * time.Millisecond
+	assert.Equal(t, [2]int{1300, 0}, observe(tick(1300)))
+}
+
+func TestHubRebasesPendingRequestsOnClockJumps(t *testing.T) {
+	h, err := newHub(defaultConfig(), "", 1)
+	assert.NoError(t, err)
+	mono := time.Duration(0)
+	h.clock = newTickClock(func() time.Duration { return mono })
+	tick := func(ts int) Packets {
+		return Packets{devicePacket(6, OpenProtocol, ts, Clock, TICK, Timestamp{Timestamp: ts})}
+	}
+	cmd := &Command{Address: 4, State: 1, Status: CommandPending, Attempts: 1, SentAt: 40}
+	h.commands.add(cmd)
+	h.commands.open[4] = cmd
+
+	mono = 40 * time.Millisecond
+	h.observe(Packets{})
+	h.requestTime[4] = []int{h.hubTime}
+	mono = 100 * time.Millisecond
+	h.observe(tick(5000))
+	assert.Equal(t, []int{4940}, h.requestTime[4])
+	assert.Equal(t, 4940, cmd.SentAt)
+	retry, failed := h.commands.expire(h.hubTime)
+	assert.Empty(t, retry)
+	assert.Empty(t, failed)
+
+	// a TICK going backwards keeps the request ageing
+	mono = 150 * time.Millisecond
+	h.observe(tick(4000))
+	assert.Equal(t, []int{3890}, h.requestTime[4])
+	h.observe(tick(4300))
+	assert.Greater(t, h.hubTime-h.requestTime[4][0], 300)
+}
+
+func TestHubRebasesTimersOnClockJumps(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Scenes = map[string]map[string]byte{"night": {"LAMP01": 0}}
+	cfg.Schedules = []Schedule{{At: "23:00", Scene: "night"}}
+	cfg.PollIntervals = map[string]int{"Switch": 0}
+	cfg.RecoveryEnabled = true
+	cfg.RecoveryBackoff = 1000
+	h, err := newHub(cfg, "", 1)
+	assert.NoError(t, err)
+	mono := time.Duration(0)
+	h.clock = newTickClock(func() time.Duration { return mono })
+	tick := func(ts int) Packets {
+		return Packets{devicePacket(6, OpenProtocol, ts, Clock, TICK, Timestamp{Timestamp: ts})}
+	}
+	h.reg.devices[3] = &Database{Address: 3, DevType: Switch, IsPresent: true}
+	h.reg.devices[4] = &Database{Address: 4, DevName: "LAMP01", DevType: Lamp, IsPresent: true}
+	dwell := &triggerState{since: -1}
+	h.engine.states[triggerKey{sensor: 2}] = dwell
+
+	// started on the monotonic fallback
+	mono = 40 * time.Millisecond
+	h.observe(Packets{})
+	h.scenes.tick(h.hubTime)
+	assert.Equal(t, []int{3}, h.scheduler.due(h.reg.devices, h.hubTime))
+	h.markAbsent(h.reg.devices[4], h.hubTime)
+	dwell.since = h.hubTime
+
+	// the first TICK is noon, the 23:00 scene waits for 23:00
+	day := 20000 * dayMillis
+	mono = 100 * time.Millisecond
+	h.observe(tick(day + 12*60*60*1000))
+	h.scenes.tick(h.hubTime)
+	assert.Empty(t, h.scenes.drain())
+	assert.Equal(t, []int{3}, h.scheduler.due(h.reg.devices, h.hubTime))
+
+	// switch polling goes on after the clock steps back an hour
+	mono = 150 * time.Millisecond
+	h.observe(tick(day + 11*60*60*1000))
+	assert.Equal(t, []int{3}, h.scheduler.due(h.reg.devices, h.hubTime))
+	assert.Equal(t, 1000-110, h.recovery[4].nextProbe-h.hubTime)
+	assert.Equal(t, -110, dwell.since-h.hubTime)
+	h.scenes.tick(h.hubTime)
+	assert.Empty(t, h.scenes.drain())
+	h.scenes.tick(day + 23*60*60*1000)
+	assert.Equal(t, []activation{{names: []string{"night"}, state: 1}}, h.scenes.drain())
+}
+
+func TestHubBatchTime(t *testing.T) {
+	h, err := newHub(defaultConfig(), "", 1)
+	assert.NoError(t, err)
+	h.clock = &fakeClock{now: 700}
+	assert.Equal(t, 700, h.batchTime(Packets{}))
+	assert.Equal(t, 900, h.batchTime(Packets{devicePacket(6, OpenProtocol, 1, Clock, TICK, Timestamp{Timestamp: 900})}))
+}
+
+func TestHubTimesOutWithoutTicks(t *testing.T) {
+	vh := newVirtualHome(t)
+	clock := &fakeClock{}
+	vh.hub.clock = clock
+	vh.hub.discover()
+	assert.Equal(t, 1100, vh.hub.hubTime)
+
+	// with the clock device gone only the hub's own clock moves time on
+	vh.clock.Down = true
+	vh.lamp.Down = true
+	vh.hub.queue.push(vh.hub.newPacket(0x04, GETSTATUS, nil), PriorityUser)
+	vh.hub.poll()
+	assert.Equal(t, []int{1100}, vh.hub.requestTime[0x04])
+	assert.True(t, vh.hub.reg.devices[0x04].IsPresent)
+
+	clock.Advance(400)
+	vh.hub.poll()
+	assert.Equal(t, 1500, vh.hub.hubTime)
+	assert.False(t, vh.hub.reg.devices[0x04].IsPresent)
+	assert.Equal(t, []Downtime{{From: 1500}}, vh.hub.reg.devices[0x04].Downtimes)
+}
@@ -0,0 +1,197 @@
+package main
+
+import "sync"
+
+const (
+	CommandQueued     string = "queued"
+	CommandPending    string = "pending"
+	CommandConfirmed  string = "confirmed"
+	CommandFailed     string = "failed"
+	CommandSuperseded string = "superseded"
+)
+
+// Command is one intent to put a device into State, it outlives the
+// SETSTATUS packets sent for it until a STATUS confirms it or the retries
+// run out.
+type Command struct {
+	ID        int      `json:"id"`
+	Address   int      `json:"address"`
+	State     byte     `json:"state"`
+	Status    string   `json:"status"`
+	Attempts  int      `json:"attempts"`
+	Serial    int      `json:"serial"`
+	SentAt    int      `json:"sent_at"`
+	UpdatedAt int      `json:"updated_at"`
+	Priority  priority `json:"-"`
+}
+
+type commandTracker struct {
+	mu       sync.RWMutex
+	retries  int
+	timeout  int
+	limit    int
+	nextID   int
+	commands map[int]*Command
+	order    []int
+	open     map[int]*Command
+	bySerial map[int]*Command
+	queued   []*Command
+}
+
+func newCommandTracker(retries, timeout, limit int) *commandTracker {
+	return &commandTracker{
+		retries:  retries,
+		timeout:  timeout,
+		limit:    limit,
+		commands: make(map[int]*Command),
+		open:     make(map[int]*Command),
+		bySerial: make(map[int]*Command),
+	}
+}
+
+func (ct *commandTracker) add(cmd *Command) {
+	ct.nextID++
+	cmd.ID = ct.nextID
+	ct.commands[cmd.ID] = cmd
+	ct.order = append(ct.order, cmd.ID)
+	if ct.limit > 0 && len(ct.order) > ct.limit {
+		for _, id := range ct.order[:len(ct.order)-ct.limit] {
+			delete(ct.commands, id)
+		}
+		ct.order = append([]int{}, ct.order[len(ct.order)-ct.limit:]...)
+	}
+}
+
+// request queues a command from outside the polling loop.
+func (ct *commandTracker) request(address int, state byte) Command {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	cmd := &Command{Address: address, State: state, Status: CommandQueued, Priority: PriorityUser}
+	ct.add(cmd)
+	ct.queued = append(ct.queued, cmd)
+	return *cmd
+}
+
+func (ct *commandTracker) drainQueued() []*Command {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	queued := ct.queued
+	ct.queued = nil
+	return queued
+}
+
+// link ties the SETSTATUS packet with serial to cmd before it is queued.
+func (ct *commandTracker) link(cmd *Command, serial int) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	cmd.Status = CommandQueued
+	ct.bySerial[serial] = cmd
+}
+
+func (ct *commandTracker) fail(cmd *Command, now int) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	cmd.Status = CommandFailed
+	cmd.UpdatedAt = now
+	if ct.open[cmd.Address] == cmd {
+		delete(ct.open, cmd.Address)
+	}
+}
+
+func (ct *commandTracker) get(id int) (Command, bool) {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	cmd, ok := ct.commands[id]
+	if !ok {
+		return Command{}, false
+	}
+	return *cmd, true
+}
+
+// sent records that a SETSTATUS went out. Packets the hub made without a
+// command, from rules or switches, get one here.
+func (ct *commandTracker) sent(pct Packet, now int) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	address := pct.Payload.Dst
+	value, _ := pct.Payload.CmdBody.(Value)
+	state := value.Value
+	cmd, ok := ct.bySerial[pct.Payload.Serial]
+	delete(ct.bySerial, pct.Payload.Serial)
+	if !ok {
+		if open, isOpen := ct.open[address]; isOpen && open.State == state {
+			cmd = open
+		} else {
+			cmd = &Command{Address: address, State: state, Priority: PriorityRule}
+			ct.add(cmd)
+		}
+	}
+
+	for serial, other := range ct.bySerial {
+		if other.Address == address && other != cmd {
+			other.Status = CommandSuperseded
+			other.UpdatedAt = now
+			delete(ct.bySerial, serial)
+		}
+	}
+	if open, isOpen := ct.open[address]; isOpen && open != cmd {
+		open.Status = CommandSuperseded
+		open.UpdatedAt = now
+	}
+
+	cmd.Status = CommandPending
+	cmd.Attempts++
+	cmd.Serial = pct.Payload.Serial
+	cmd.SentAt = now
+	cmd.UpdatedAt = now
+	ct.open[address] = cmd
+}
+
+// status confirms the open command of address when the device reports the
+// state it was asked for.
+func (ct *commandTracker) status(address int, value byte, now int) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	cmd, ok := ct.open[address]
+	if !ok || cmd.State != value {
+		return
+	}
+	cmd.Status = CommandConfirmed
+	cmd.UpdatedAt = now
+	delete(ct.open, address)
+}
+
+// rebase moves the send time of the pending commands by shift when the
+// hub's clock jumps.
+func (ct *commandTracker) rebase(shift int) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	for _, cmd := range ct.open {
+		if cmd.Status == CommandPending {
+			cmd.SentAt += shift
+		}
+	}
+}
+
+// expire returns the open commands left unconfirmed for longer than the
+// timeout, split into those to send again and those out of retries, which
+// are closed as failed.
+func (ct *commandTracker) expire(now int) ([]*Command, []*Command) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	var retry, failed []*Command
+	for address, cmd := range ct.open {
+		if cmd.Status != CommandPending || now-cmd.SentAt <= ct.timeout {
+			continue
+		}
+		if cmd.Attempts <= ct.retries {
+			retry = append(retry, cmd)
+			continue
+		}
+		cmd.Status = CommandFailed
+		cmd.UpdatedAt = now
+		delete(ct.open, address)
+		failed = append(failed, cmd)
+	}
+	return retry, failed
+}
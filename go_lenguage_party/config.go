@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const ConfigEnv string = "HUB_CONFIG"
+
+// OverridesFile is where a hub started with a config keeps its operator
+// overrides unless overrides_path says otherwise, next to the config file.
+// Without a config, or with overrides_path set to "", they are not
+// persisted.
+const OverridesFile string = "overrides.json"
+
+type Config struct {
+	APIAddr             string                     `json:"api_addr"`
+	HistoryRetention    int                        `json:"history_retention"`
+	TriggerHysteresis   int                        `json:"trigger_hysteresis"`
+	TriggerDwell        int                        `json:"trigger_dwell"`
+	OverridesPath       string                     `json:"overrides_path"`
+	Overrides           map[string]DeviceOverride  `json:"overrides"`
+	Groups              map[string][]string        `json:"groups"`
+	Scenes              map[string]map[string]byte `json:"scenes"`
+	Schedules           []Schedule                 `json:"schedules"`
+	HealthStaleAfter    int                        `json:"health_stale_after"`
+	DegradedAfterErrors int                        `json:"degraded_after_errors"`
+	StopAfterErrors     int                        `json:"stop_after_errors"`
+	DegradedBackoff     int                        `json:"degraded_backoff"`
+	DegradedMaxBackoff  int                        `json:"degraded_max_backoff"`
+	RediscoverAfter     int                        `json:"rediscover_after"`
+	RediscoverInterval  int                        `json:"rediscover_interval"`
+	ForgetAfter         int                        `json:"forget_after"`
+	EventLogSize        int                        `json:"event_log_size"`
+	RecoveryEnabled     bool                       `json:"recovery_enabled"`
+	RecoveryBackoff     int                        `json:"recovery_backoff"`
+	RecoveryMaxBackoff  int                        `json:"recovery_max_backoff"`
+	DowntimeHistory     int                        `json:"downtime_history"`
+	PollIntervals       map[string]int             `json:"poll_intervals"`
+	PollJitter          int                        `json:"poll_jitter"`
+	PollFastInterval    int                        `json:"poll_fast_interval"`
+	PollFastFor         int                        `json:"poll_fast_for"`
+	PollBatchLimit      int                        `json:"poll_batch_limit"`
+	MaxBodySize         int                        `json:"max_body_size"`
+	CommandRetries      int                        `json:"command_retries"`
+	CommandTimeout      int                        `json:"command_timeout"`
+	CommandHistory      int                        `json:"command_history"`
+	SerialMax           int                        `json:"serial_max"`
+	SerialPath          string                     `json:"serial_path"`
+	SerialBlock         int                        `json:"serial_block"`
+	ReplayWindow        int                        `json:"replay_window"`
+	CRC8                CRC8Params                 `json:"crc8"`
+	ProtocolVersion     int                        `json:"protocol_version"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		APIAddr:             "",
+		HistoryRetention:    24 * 60 * 60 * 1000,
+		TriggerHysteresis:   0,
+		TriggerDwell:        0,
+		OverridesPath:       "",
+		Overrides:           nil,
+		Groups:              map[string][]string{},
+		Scenes:              map[string]map[string]byte{},
+		Schedules:           nil,
+		HealthStaleAfter:    5000,
+		DegradedAfterErrors: 3,
+		StopAfterErrors:     30,
+		DegradedBackoff:     500,
+		DegradedMaxBackoff:  30 * 1000,
+		RediscoverAfter:     3,
+		RediscoverInterval:  60 * 1000,
+		ForgetAfter:         0,
+		EventLogSize:        1000,
+		RecoveryEnabled:     true,
+		RecoveryBackoff:     1000,
+		RecoveryMaxBackoff:  60 * 1000,
+		DowntimeHistory:     32,
+		PollIntervals: map[string]int{
+			"Switch":    0,
+			"Lamp":      -1,
+			"Socket":    -1,
+			"EnvSensor": -1,
+		},
+		PollJitter:       0,
+		PollFastInterval: 0,
+		PollFastFor:      0,
+		PollBatchLimit:   0,
+		MaxBodySize:      0,
+		CommandRetries:   2,
+		CommandTimeout:   300,
+		CommandHistory:   1000,
+		SerialMax:        1<<31 - 1,
+		SerialPath:       "",
+		SerialBlock:      1000,
+		ReplayWindow:     64,
+		CRC8:             defaultCRC8Params,
+		ProtocolVersion:  supportedProtocolVersion,
+	}
+}
+
+// loadConfig reads the JSON config at path on top of the defaults, an empty
+// path keeps the defaults as they are.
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+	cfg.OverridesPath = filepath.Join(filepath.Dir(path), OverridesFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func (cfg Config) healthStaleAfter() time.Duration {
+	return time.Duration(cfg.HealthStaleAfter) * time.Millisecond
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCRC8TableMatchesVectors(t *testing.T) {
+	ct := newCRC8Table(defaultCRC8Params)
+	for _, req := range tests {
+		data, err := base64.RawURLEncoding.DecodeString(removeSpaces(req.request))
+		assert.NoError(t, err)
+		for skip := 0; skip < len(data); {
+			length := int(data[skip])
+			payload := data[skip+1 : skip+1+length]
+			assert.Equal(t, data[skip+1+length], ct.checksum(payload), req.tcName)
+			assert.Equal(t, computeCRC8Simple(payload), ct.checksum(payload), req.tcName)
+			skip += length + 2
+		}
+	}
+}
+
+func TestCRC8Variants(t *testing.T) {
+	check := []byte("123456789")
+	// catalogue check values for the CRC-8 variants sharing this layout
+	assert.Equal(t, byte(0x37), newCRC8Table(CRC8Params{Poly: 0x1D}).checksum(check))
+	assert.Equal(t, byte(0x4B), newCRC8Table(CRC8Params{Poly: 0x1D, Init: 0xFF, XorOut: 0xFF}).checksum(check))
+	assert.Equal(t, byte(0xF4), newCRC8Table(CRC8Params{Poly: 0x07}).checksum(check))
+	assert.Equal(t, byte(0xA1), newCRC8Table(CRC8Params{Poly: 0x07, XorOut: 0x55}).checksum(check))
+	assert.Error(t, CRC8Params{}.validate())
+}
+
+func TestHubUsesConfiguredCRC8(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.CRC8 = CRC8Params{Poly: 0x07, XorOut: 0x55}
+	h, err := newHub(cfg, "", 1)
+	assert.NoError(t, err)
+	pct := h.newPacket(OpenProtocol, WHOISHERE, Name{DevName: HubName})
+	assert.Equal(t, newCRC8Table(cfg.CRC8).checksum(pct.Payload.toBytes()), pct.Crc8)
+
+	decoded, _, _ := h.codec.packetFromBytes(pct.toBytes())
+	assert.NotNil(t, decoded)
+	decoded, _, _ = packetFromBytes(pct.toBytes())
+	assert.Nil(t, decoded)
+
+	// a second hub on the default variant is unaffected
+	plain, err := newHub(defaultConfig(), "", 1)
+	assert.NoError(t, err)
+	pct = plain.newPacket(OpenProtocol, WHOISHERE, Name{DevName: HubName})
+	assert.Equal(t, computeCRC8Simple(pct.Payload.toBytes()), pct.Crc8)
+
+	cfg.CRC8 = CRC8Params{}
+	_, err = newHub(cfg, "", 1)
+	assert.Error(t, err)
+}
+
+func TestParseCRC8Params(t *testing.T) {
+	params, err := parseCRC8Params("07,0,55")
+	assert.NoError(t, err)
+	assert.Equal(t, CRC8Params{Poly: 0x07, XorOut: 0x55}, params)
+	params, err = parseCRC8Params("0x1D")
+	assert.NoError(t, err)
+	assert.Equal(t, defaultCRC8Params, params)
+	for _, bad := range []string{"", "0", "1d,0,0,0", "zz", "100"} {
+		_, err = parseCRC8Params(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func BenchmarkCRC8Simple(b *testing.B) {
+	data := benchBatch().toBytes()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		computeCRC8Simple(data)
+	}
+}
+
+func BenchmarkCRC8Table(b *testing.B) {
+	data := benchBatch().toBytes()
+	ct := newCRC8Table(defaultCRC8Params)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		ct.checksum(data)
+	}
+}
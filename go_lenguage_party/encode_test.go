@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// benchBatch is a batch the hub would send in one round: a broadcast, a
+// poll, a couple of commands and a discovery answer.
+func benchBatch() Packets {
+	return Packets{
+		devicePacket(0x0001, OpenProtocol, 1, SmartHub, WHOISHERE, Name{DevName: HubName}),
+		devicePacket(0x0001, 0x0002, 2, SmartHub, GETSTATUS, nil),
+		devicePacket(0x0001, 0x0003, 3, Lamp, SETSTATUS, Value{Value: 1}),
+		devicePacket(0x0001, 0x0004, 4, Socket, SETSTATUS, Value{Value: 0}),
+		devicePacket(0x0002, 0x0001, 5, EnvSensor, IAMHERE, Sensors{
+			DevName: "SENSOR01",
+			DevProps: EnvSensorProps{Sensors: 0x0F, Triggers: []Trigger{
+				{Op: 0x0C, Value: 100, Name: "OTHER1"},
+				{Op: 0x0F, Value: 1200, Name: "OTHER2"},
+			}},
+		}),
+		devicePacket(0x0005, 0x0001, 6, Switch, IAMHERE, SwitchDevice{
+			DevName:  "SWITCH01",
+			DevProps: DevProps{DevNames: []string{"DEV01", "DEV02", "DEV03"}},
+		}),
+	}
+}
+
+func TestAppendBytesMatchesToBytes(t *testing.T) {
+	batch := benchBatch()
+	assert.Equal(t, batch.toBytes(), batch.appendBytes(nil))
+	prefix := []byte{0xAA, 0xBB}
+	assert.Equal(t, append([]byte{0xAA, 0xBB}, batch.toBytes()...), batch.appendBytes(prefix))
+}
+
+func TestAppendBytesDoesNotAllocate(t *testing.T) {
+	batch := benchBatch()
+	buf := make([]byte, 0, 1024)
+	allocs := testing.AllocsPerRun(100, func() {
+		buf = batch.appendBytes(buf[:0])
+	})
+	assert.Equal(t, 0.0, allocs)
+}
+
+func TestSealMatchesPayload(t *testing.T) {
+	pct := Packet{Payload: Payload{Src: 0x0001, Dst: 0x0003, Serial: 300, DevType: Lamp, Cmd: SETSTATUS, CmdBody: Value{Value: 1}}}
+	buf := pct.seal(nil)
+	data := pct.Payload.toBytes()
+	assert.Equal(t, data, buf)
+	assert.Equal(t, byte(len(data)), pct.Length)
+	assert.Equal(t, computeCRC8Simple(data), pct.Crc8)
+}
+
+func sealAllocs(pct Packet) float64 {
+	buf := make([]byte, 0, 256)
+	return testing.AllocsPerRun(100, func() {
+		buf = pct.seal(buf)
+	})
+}
+
+func TestSealDoesNotAllocate(t *testing.T) {
+	for _, pct := range benchBatch() {
+		assert.Equal(t, 0.0, sealAllocs(pct), "%+v", pct.Payload)
+	}
+
+	h, err := newHub(defaultConfig(), "", 1)
+	assert.NoError(t, err)
+	var body CmdBodyBytes = Value{Value: 1}
+	h.newPacketAs(Lamp, 4, SETSTATUS, body)
+	allocs := testing.AllocsPerRun(100, func() {
+		h.newPacketAs(Lamp, 4, SETSTATUS, body)
+	})
+	assert.Equal(t, 0.0, allocs)
+}
+
+func BenchmarkPacketsToBytes(b *testing.B) {
+	batch := benchBatch()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		batch.toBytes()
+	}
+}
+
+func BenchmarkPacketsAppendBytes(b *testing.B) {
+	batch := benchBatch()
+	var buf []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = batch.appendBytes(buf[:0])
+	}
+}
+
+func BenchmarkPacketSeal(b *testing.B) {
+	pct := benchBatch()[4]
+	if allocs := sealAllocs(pct); allocs != 0 {
+		b.Fatalf("seal allocates %v times per packet", allocs)
+	}
+	var buf []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = pct.seal(buf)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import "sync"
+
+const (
+	EventAdded          string = "added"
+	EventRemoved        string = "removed"
+	EventRenamed        string = "renamed"
+	EventMoved          string = "moved"
+	EventCollision      string = "collision"
+	EventCommandFailed  string = "command_failed"
+	EventUnknownCommand string = "unknown_command"
+)
+
+type DeviceEvent struct {
+	Seq        int     `json:"seq"`
+	Kind       string  `json:"kind"`
+	Address    int     `json:"address"`
+	OldAddress int     `json:"old_address,omitempty"`
+	DevName    string  `json:"dev_name"`
+	OldName    string  `json:"old_name,omitempty"`
+	DevType    devType `json:"dev_type"`
+	Cmd        cmd     `json:"cmd,omitempty"`
+	Body       []byte  `json:"body,omitempty"`
+	Time       int     `json:"time"`
+}
+
+// eventLog keeps the last limit registry changes, readers page through them
+// by sequence number.
+type eventLog struct {
+	mu     sync.RWMutex
+	limit  int
+	seq    int
+	events []DeviceEvent
+}
+
+func newEventLog(limit int) *eventLog {
+	return &eventLog{limit: limit}
+}
+
+func (el *eventLog) emit(ev DeviceEvent) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	el.seq++
+	ev.Seq = el.seq
+	el.events = append(el.events, ev)
+	if el.limit > 0 && len(el.events) > el.limit {
+		el.events = el.events[len(el.events)-el.limit:]
+	}
+}
+
+func (el *eventLog) since(seq int) []DeviceEvent {
+	el.mu.RLock()
+	defer el.mu.RUnlock()
+	events := make([]DeviceEvent, 0)
+	for _, ev := range el.events {
+		if ev.Seq > seq {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
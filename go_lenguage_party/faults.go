@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+)
+
+// FaultRule gives the chance of each fault for one reply packet, Delay
+// holds the packet back for DelayMs of network time.
+type FaultRule struct {
+	Drop      float64 `json:"drop"`
+	Delay     float64 `json:"delay"`
+	DelayMs   int     `json:"delay_ms"`
+	Corrupt   float64 `json:"corrupt"`
+	Truncate  float64 `json:"truncate"`
+	Duplicate float64 `json:"duplicate"`
+	Reorder   float64 `json:"reorder"`
+}
+
+// FaultConfig is the proxy's -faults file. A rule under a device's hex
+// address replaces the global one for that device's replies.
+type FaultConfig struct {
+	Seed    int64                `json:"seed"`
+	Global  FaultRule            `json:"global"`
+	Devices map[string]FaultRule `json:"devices"`
+}
+
+// defaultFaultDelay is past the 300 ms the hub waits for a reply.
+const defaultFaultDelay = 500
+
+func loadFaultConfig(path string) (FaultConfig, error) {
+	var fc FaultConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fc, err
+	}
+	err = json.Unmarshal(data, &fc)
+	return fc, err
+}
+
+type heldFrame struct {
+	due   int
+	frame []byte
+}
+
+// faultInjector damages the reply batches of the network. Time is the
+// network's own, taken from the last TICK, so delays line up with the
+// hub's timeouts.
+type faultInjector struct {
+	codec   codec
+	global  FaultRule
+	devices map[int]FaultRule
+	rnd     *rand.Rand
+	start   time.Time
+	now     int
+	ticked  bool
+	held    []heldFrame
+}
+
+func newFaultInjector(fc FaultConfig, c codec) (*faultInjector, error) {
+	fi := &faultInjector{
+		codec:   c,
+		global:  fc.Global,
+		devices: make(map[int]FaultRule),
+		rnd:     rand.New(rand.NewSource(fc.Seed)),
+		start:   time.Now(),
+	}
+	for key, rule := range fc.Devices {
+		addr, err := strconv.ParseInt(key, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad fault device %q", key)
+		}
+		fi.devices[int(addr)] = rule
+	}
+	return fi, nil
+}
+
+func (fi *faultInjector) rule(frame []byte) FaultRule {
+	if src, _, err := decodeULEB128(frame[1:]); err == nil {
+		if rule, ok := fi.devices[src]; ok {
+			return rule
+		}
+	}
+	return fi.global
+}
+
+func (fi *faultInjector) hit(chance float64) bool {
+	return chance > 0 && fi.rnd.Float64() < chance
+}
+
+// clock advances the network time from the batch's TICK, before the first
+// TICK it runs on the wall clock.
+func (fi *faultInjector) clock(data []byte) {
+	if tick := findTime(*fi.codec.packetsFromBytes(data)); tick >= 0 {
+		fi.now, fi.ticked = tick, true
+	} else if !fi.ticked {
+		fi.now = int(time.Since(fi.start).Milliseconds())
+	}
+}
+
+// apply returns the reply batch data as it reaches the hub.
+func (fi *faultInjector) apply(data []byte) []byte {
+	fi.clock(data)
+	var frames [][]byte
+	held := fi.held[:0]
+	for _, h := range fi.held {
+		if h.due <= fi.now {
+			frames = append(frames, h.frame)
+		} else {
+			held = append(held, h)
+		}
+	}
+	fi.held = held
+
+	for _, frame := range splitFrames(data) {
+		rule := fi.rule(frame)
+		if fi.hit(rule.Drop) {
+			continue
+		}
+		if fi.hit(rule.Delay) {
+			delay := rule.DelayMs
+			if delay <= 0 {
+				delay = defaultFaultDelay
+			}
+			fi.held = append(fi.held, heldFrame{due: fi.now + delay, frame: frame})
+			continue
+		}
+		if fi.hit(rule.Corrupt) {
+			frame = append([]byte(nil), frame...)
+			// the length byte stays intact so only this frame fails its crc8
+			bit := fi.rnd.Intn((len(frame) - 1) * 8)
+			frame[1+bit/8] ^= 1 << (bit % 8)
+		}
+		if fi.hit(rule.Truncate) {
+			frame = frame[:1+fi.rnd.Intn(len(frame)-1)]
+		}
+		frames = append(frames, frame)
+		if fi.hit(rule.Duplicate) {
+			frames = append(frames, frame)
+		}
+	}
+
+	for i := range frames {
+		if fi.hit(fi.rule(frames[i]).Reorder) {
+			j := fi.rnd.Intn(len(frames))
+			frames[i], frames[j] = frames[j], frames[i]
+		}
+	}
+	out := make([]byte, 0, len(data))
+	for _, frame := range frames {
+		out = append(out, frame...)
+	}
+	return out
+}
+
+// splitFrames cuts a batch into its length-prefixed frames, a cut short
+// tail is dropped.
+func splitFrames(data []byte) [][]byte {
+	var frames [][]byte
+	for skip := 0; skip < len(data); {
+		end := skip + int(data[skip]) + 2
+		if end > len(data) {
+			break
+		}
+		frames = append(frames, data[skip:end])
+		skip = end
+	}
+	return frames
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func faultBatch(tick int) Packets {
+	return Packets{
+		devicePacket(6, OpenProtocol, tick, Clock, TICK, Timestamp{Timestamp: tick}),
+		devicePacket(4, 1, tick, Lamp, STATUS, Value{Value: 1}),
+		devicePacket(5, 1, tick, Socket, STATUS, Value{Value: 0}),
+	}
+}
+
+func TestFaultInjectorPassesCleanBatches(t *testing.T) {
+	fi, err := newFaultInjector(FaultConfig{}, defaultCodec)
+	assert.NoError(t, err)
+	data := faultBatch(1000).toBytes()
+	assert.Equal(t, data, fi.apply(data))
+}
+
+func TestFaultInjectorIsSeeded(t *testing.T) {
+	fc := FaultConfig{Seed: 42, Global: FaultRule{Drop: 0.3, Corrupt: 0.3, Duplicate: 0.3, Reorder: 0.3, Truncate: 0.1}}
+	first, _ := newFaultInjector(fc, defaultCodec)
+	second, _ := newFaultInjector(fc, defaultCodec)
+	for tick := 1000; tick < 20000; tick += 100 {
+		data := faultBatch(tick).toBytes()
+		assert.Equal(t, first.apply(data), second.apply(data))
+	}
+}
+
+func TestFaultInjectorPerDevice(t *testing.T) {
+	fi, err := newFaultInjector(FaultConfig{Devices: map[string]FaultRule{"4": {Drop: 1}, "5": {Duplicate: 1}}}, defaultCodec)
+	assert.NoError(t, err)
+	pcts := *packetsFromBytes(fi.apply(faultBatch(1000).toBytes()))
+	batch := faultBatch(1000)
+	assert.Equal(t, Packets{batch[0], batch[2], batch[2]}, pcts)
+
+	_, err = newFaultInjector(FaultConfig{Devices: map[string]FaultRule{"lamp": {}}}, defaultCodec)
+	assert.Error(t, err)
+}
+
+func TestFaultInjectorCorruptBreaksCRC(t *testing.T) {
+	fi, _ := newFaultInjector(FaultConfig{Seed: 7, Devices: map[string]FaultRule{"4": {Corrupt: 1}}}, defaultCodec)
+	before := metrics.crcFailures.get()
+	pcts := *packetsFromBytes(fi.apply(faultBatch(1000).toBytes()))
+	assert.Len(t, pcts, 2)
+	assert.Equal(t, before+1, metrics.crcFailures.get())
+}
+
+func TestFaultInjectorDelaysPastTimeout(t *testing.T) {
+	fi, _ := newFaultInjector(FaultConfig{Devices: map[string]FaultRule{"4": {Delay: 1}}}, defaultCodec)
+	lamp := faultBatch(1000)[1]
+
+	pcts := *packetsFromBytes(fi.apply(faultBatch(1000).toBytes()))
+	assert.NotContains(t, pcts, lamp)
+	pcts = *packetsFromBytes(fi.apply(faultBatch(1300).toBytes()))
+	assert.NotContains(t, pcts, lamp)
+
+	// the held reply comes out once the network time passes its due time
+	fi.devices = map[int]FaultRule{}
+	pcts = *packetsFromBytes(fi.apply(Packets{faultBatch(1600)[0]}.toBytes()))
+	assert.Contains(t, pcts, lamp)
+}
+
+func TestFaultInjectorTruncate(t *testing.T) {
+	fi, _ := newFaultInjector(FaultConfig{Seed: 3, Global: FaultRule{Truncate: 1}}, defaultCodec)
+	data := faultBatch(1000).toBytes()
+	assert.Less(t, len(fi.apply(data)), len(data))
+	assert.NotPanics(t, func() { packetsFromBytes(fi.apply(data)) })
+}
+
+func TestProxyInjectsFaults(t *testing.T) {
+	answer := faultBatch(1000)
+	upstream := fakeNetwork(answer)
+	defer upstream.Close()
+	p := newProxy(upstream.URL, proxyFilter{}, io.Discard)
+	p.faults, _ = newFaultInjector(FaultConfig{Devices: map[string]FaultRule{"5": {Drop: 1}}}, defaultCodec)
+	proxied := httptest.NewServer(p)
+	defer proxied.Close()
+
+	body, status, err := requestServer(proxied.URL, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(answer[:2].toBytes()), string(body))
+}
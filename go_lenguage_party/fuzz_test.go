@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// seedPackets are the decoded request vectors of main_test.go.
+func seedPackets(f *testing.F) [][]byte {
+	var seeds [][]byte
+	for _, req := range tests {
+		data, err := base64.RawURLEncoding.DecodeString(removeSpaces(req.request))
+		if err != nil {
+			f.Fatal(err)
+		}
+		seeds = append(seeds, data)
+	}
+	return seeds
+}
+
+func FuzzPacketsFromBytes(f *testing.F) {
+	for _, seed := range seedPackets(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pcts := packetsFromBytes(data)
+		for _, pct := range *pcts {
+			encoded := pct.Payload.toBytes()
+			again := payloadFromBytes(encoded)
+			if !assert.NotNil(t, again) {
+				continue
+			}
+			assert.Equal(t, pct.Payload, *again)
+			assert.Equal(t, encoded, again.toBytes())
+		}
+	})
+}
+
+func FuzzDecodeULEB128(f *testing.F) {
+	f.Add([]byte{0x00})
+	f.Add([]byte{0xE5, 0x8E, 0x26})
+	f.Add([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01})
+	f.Add([]byte{0x80})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		value, skip, err := decodeULEB128(data)
+		if err != nil {
+			return
+		}
+		assert.LessOrEqual(t, skip, len(data))
+		assert.GreaterOrEqual(t, value, 0)
+		encoded := encodeULEB128(value)
+		assert.Equal(t, data[:skip], encoded)
+		again, _, err := decodeULEB128(encoded)
+		assert.NoError(t, err)
+		assert.Equal(t, value, again)
+	})
+}
+
+func FuzzParsedCMDBody(f *testing.F) {
+	for _, seed := range seedPackets(f) {
+		for _, pct := range *packetsFromBytes(seed) {
+			body := []byte{}
+			if pct.Payload.CmdBody != nil {
+				body = pct.Payload.CmdBody.toBytes()
+			}
+			f.Add(byte(pct.Payload.DevType), byte(pct.Payload.Cmd), body)
+		}
+	}
+	f.Fuzz(func(t *testing.T, dt, c byte, body []byte) {
+		parsed := parsedCMDBody(devType(dt), cmd(c), body)
+		if parsed == nil {
+			return
+		}
+		again := parsedCMDBody(devType(dt), cmd(c), parsed.toBytes())
+		assert.Equal(t, parsed, again)
+	})
+}
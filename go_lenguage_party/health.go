@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// hubHealth follows the polling loop in server: when it last got an answer
+// from the network and whether the initial discovery is over.
+type hubHealth struct {
+	mu            sync.RWMutex
+	started       time.Time
+	lastRoundTrip time.Time
+	lastErr       error
+	discovered    bool
+	state         hubState
+	staleAfter    time.Duration
+}
+
+type HealthReport struct {
+	Status        string    `json:"status"`
+	State         string    `json:"state"`
+	LastRoundTrip time.Time `json:"last_round_trip"`
+	SinceMillis   int64     `json:"since_last_round_trip_ms"`
+	Discovered    bool      `json:"discovered"`
+	Reachable     bool      `json:"reachable"`
+	Error         string    `json:"error,omitempty"`
+}
+
+func newHubHealth(staleAfter time.Duration) *hubHealth {
+	return &hubHealth{started: time.Now(), staleAfter: staleAfter}
+}
+
+func (hh *hubHealth) roundTrip(status int, err error) {
+	hh.mu.Lock()
+	defer hh.mu.Unlock()
+	if err == nil && status != http.StatusOK && status != http.StatusNoContent {
+		err = fmt.Errorf("unexpected status %d", status)
+	}
+	hh.lastErr = err
+	if err == nil {
+		hh.lastRoundTrip = time.Now()
+	}
+}
+
+func (hh *hubHealth) setDiscovered() {
+	hh.mu.Lock()
+	defer hh.mu.Unlock()
+	hh.discovered = true
+}
+
+func (hh *hubHealth) setState(state hubState) {
+	hh.mu.Lock()
+	defer hh.mu.Unlock()
+	hh.state = state
+}
+
+func (hh *hubHealth) report() HealthReport {
+	hh.mu.RLock()
+	defer hh.mu.RUnlock()
+	last := hh.lastRoundTrip
+	if last.IsZero() {
+		last = hh.started
+	}
+	rep := HealthReport{
+		Status:        "ok",
+		State:         hh.state.String(),
+		LastRoundTrip: hh.lastRoundTrip,
+		SinceMillis:   time.Since(last).Milliseconds(),
+		Discovered:    hh.discovered,
+		Reachable:     !hh.lastRoundTrip.IsZero() && hh.lastErr == nil,
+	}
+	if hh.lastErr != nil {
+		rep.Error = hh.lastErr.Error()
+	}
+	return rep
+}
+
+// healthz fails once the loop hasn't completed a round trip for staleAfter,
+// which is what a wedged hub looks like from outside.
+func (hh *hubHealth) healthz(w http.ResponseWriter, r *http.Request) {
+	rep := hh.report()
+	status := http.StatusOK
+	if time.Duration(rep.SinceMillis)*time.Millisecond > hh.staleAfter {
+		rep.Status = "stale"
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, rep)
+}
+
+// readyz fails until the first WHOISHERE round populated the registry and
+// while the network endpoint doesn't answer.
+func (hh *hubHealth) readyz(w http.ResponseWriter, r *http.Request) {
+	rep := hh.report()
+	status := http.StatusOK
+	if !rep.Discovered || !rep.Reachable {
+		rep.Status = "not ready"
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, rep)
+}
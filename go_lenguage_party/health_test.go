@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	h, err := newHub(defaultConfig(), "", 1)
+	assert.NoError(t, err)
+	health := h.health
+	health.staleAfter = time.Minute
+	mux := newAPI(h)
+	status := func(path string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, status("/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, status("/readyz"))
+
+	health.roundTrip(http.StatusOK, nil)
+	health.setDiscovered()
+	assert.Equal(t, http.StatusOK, status("/readyz"))
+
+	health.roundTrip(0, errors.New("connection refused"))
+	assert.Equal(t, http.StatusServiceUnavailable, status("/readyz"))
+	assert.Equal(t, http.StatusOK, status("/healthz"))
+
+	health.staleAfter = 0
+	time.Sleep(time.Millisecond)
+	assert.Equal(t, http.StatusServiceUnavailable, status("/healthz"))
+}
+
+func TestServeAPIReportsBindErrors(t *testing.T) {
+	h, err := newHub(defaultConfig(), "", 1)
+	assert.NoError(t, err)
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer taken.Close()
+
+	assert.Error(t, serveAPI(taken.Addr().String(), h))
+	assert.Error(t, serveAPI("127.0.0.1:port", h))
+}
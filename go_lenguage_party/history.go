@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+type sample struct {
+	Time  int
+	Value int
+}
+
+type historyKey struct {
+	device int
+	sensor sensorType
+}
+
+type Bucket struct {
+	From  int     `json:"from"`
+	To    int     `json:"to"`
+	Min   int     `json:"min"`
+	Max   int     `json:"max"`
+	Avg   float64 `json:"avg"`
+	Count int     `json:"count"`
+}
+
+// historyStore keeps every EnvSensor reading by hub time, samples older than
+// retention are dropped as new ones arrive.
+type historyStore struct {
+	mu        sync.RWMutex
+	retention int
+	series    map[historyKey][]sample
+}
+
+func newHistoryStore(retention int) *historyStore {
+	return &historyStore{
+		retention: retention,
+		series:    make(map[historyKey][]sample),
+	}
+}
+
+func (hs *historyStore) record(device, time int, rds Readings) {
+	if time < 0 {
+		return
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	for i := 0; i < sensorTypes; i++ {
+		value, ok := rds.get(sensorType(i))
+		if !ok {
+			continue
+		}
+		key := historyKey{device: device, sensor: sensorType(i)}
+		samples := append(hs.series[key], sample{Time: time, Value: value})
+		if hs.retention > 0 {
+			cut := sort.Search(len(samples), func(j int) bool {
+				return samples[j].Time >= time-hs.retention
+			})
+			samples = samples[cut:]
+		}
+		hs.series[key] = samples
+	}
+}
+
+// History returns the readings of one sensor within [from, to] grouped into
+// buckets of step milliseconds, a non-positive step gives a bucket per sample.
+func (hs *historyStore) History(device int, sensor sensorType, from, to, step int) []Bucket {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+	samples := hs.series[historyKey{device: device, sensor: sensor}]
+	start := sort.Search(len(samples), func(i int) bool {
+		return samples[i].Time >= from
+	})
+
+	buckets := make([]Bucket, 0)
+	sum := 0
+	for _, smp := range samples[start:] {
+		if smp.Time > to {
+			break
+		}
+		bucketFrom, bucketTo := smp.Time, smp.Time
+		if step > 0 {
+			bucketFrom = from + (smp.Time-from)/step*step
+			bucketTo = bucketFrom + step - 1
+		}
+		last := len(buckets) - 1
+		if last < 0 || buckets[last].From != bucketFrom {
+			buckets = append(buckets, Bucket{
+				From: bucketFrom,
+				To:   bucketTo,
+				Min:  smp.Value,
+				Max:  smp.Value,
+			})
+			last++
+			sum = 0
+		}
+		bkt := &buckets[last]
+		if smp.Value < bkt.Min {
+			bkt.Min = smp.Value
+		}
+		if smp.Value > bkt.Max {
+			bkt.Max = smp.Value
+		}
+		sum += smp.Value
+		bkt.Count++
+		bkt.Avg = float64(sum) / float64(bkt.Count)
+	}
+	return buckets
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistoryDownsampling(t *testing.T) {
+	hs := newHistoryStore(1000)
+	for i, value := range []int{20, 22, 21, 25, 30} {
+		hs.record(1, i*100, readingsFromValues(0b0001, []int{value}))
+	}
+
+	assert.Equal(t, []Bucket{
+		{From: 0, To: 199, Min: 20, Max: 22, Avg: 21, Count: 2},
+		{From: 200, To: 399, Min: 21, Max: 25, Avg: 23, Count: 2},
+		{From: 400, To: 599, Min: 30, Max: 30, Avg: 30, Count: 1},
+	}, hs.History(1, Temperature, 0, 1000, 200))
+	assert.Len(t, hs.History(1, Temperature, 100, 300, 0), 3)
+	assert.Empty(t, hs.History(1, Humidity, 0, 1000, 200))
+
+	hs.record(1, 1250, readingsFromValues(0b0001, []int{18}))
+	assert.Len(t, hs.History(1, Temperature, 0, 2000, 0), 3)
+}
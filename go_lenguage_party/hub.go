@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+type hubState byte
+
+const (
+	Discovering hubState = 0x01
+	Running     hubState = 0x02
+	Degraded    hubState = 0x03
+	Stopped     hubState = 0x04
+)
+
+var hubStateNames = map[hubState]string{
+	Discovering: "discovering",
+	Running:     "running",
+	Degraded:    "degraded",
+	Stopped:     "stopped",
+}
+
+func (st hubState) String() string {
+	return hubStateNames[st]
+}
+
+type transitionHook func(from, to hubState)
+
+// hub drives the protocol: Discovering broadcasts WHOISHERE until the
+// network answers, Running polls the devices, Degraded keeps polling after
+// repeated transport errors and Stopped ends the process with exitCode.
+type hub struct {
+	cfg     Config
+	codec   codec
+	url     string
+	address int
+	serial  *serialAllocator
+
+	state           hubState
+	resumeState     hubState
+	hooks           []transitionHook
+	transportErrors int
+	discovered      bool
+	exitCode        int
+
+	reg         *registry
+	history     *historyStore
+	engine      *triggerEngine
+	overrides   *overrideStore
+	scenes      *sceneController
+	health      *hubHealth
+	events      *eventLog
+	recovery    recoveryStates
+	scheduler   *pollScheduler
+	commands    *commandTracker
+	replays     *replayFilter
+	requestTime map[int][]int
+	queue       *outboundQueue
+	clock       NetworkClock
+	hubTime     int
+	lastWhois   int
+
+	// wire is reused between rounds to encode the outgoing batch
+	wire []byte
+	// transport posts a batch, requestServer unless a test swaps it
+	transport func(url, request string) ([]byte, int, error)
+	// sleep waits out the backoff between failed rounds while Degraded
+	sleep func(time.Duration)
+}
+
+func newHub(cfg Config, url string, address int) (*hub, error) {
+	if address < 0 || address >= OpenProtocol {
+		return nil, fmt.Errorf("hub address %x out of range", address)
+	}
+	if err := cfg.CRC8.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateProtocolVersion(cfg.ProtocolVersion); err != nil {
+		return nil, err
+	}
+	overrides, err := newOverrideStore(cfg.OverridesPath, cfg.Overrides)
+	if err != nil {
+		return nil, err
+	}
+	scenes, err := newSceneController(cfg.Groups, cfg.Scenes, cfg.Schedules)
+	if err != nil {
+		return nil, err
+	}
+	scheduler, err := newPollScheduler(cfg, time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerialAllocator(cfg.SerialMax, cfg.SerialPath, cfg.SerialBlock)
+	if err != nil {
+		return nil, err
+	}
+	h := &hub{
+		cfg:         cfg,
+		codec:       newCodec(cfg.CRC8),
+		url:         url,
+		address:     address,
+		serial:      serial,
+		replays:     newReplayFilter(cfg.ReplayWindow),
+		state:       Discovering,
+		reg:         newRegistry(),
+		history:     newHistoryStore(cfg.HistoryRetention),
+		engine:      newTriggerEngine(cfg.TriggerHysteresis, cfg.TriggerDwell),
+		overrides:   overrides,
+		scenes:      scenes,
+		health:      newHubHealth(cfg.healthStaleAfter()),
+		events:      newEventLog(cfg.EventLogSize),
+		recovery:    make(recoveryStates),
+		scheduler:   scheduler,
+		commands:    newCommandTracker(cfg.CommandRetries, cfg.CommandTimeout, cfg.CommandHistory),
+		requestTime: make(map[int][]int),
+		queue:       newOutboundQueue(cfg.MaxBodySize),
+		transport:   requestServer,
+		sleep:       time.Sleep,
+		clock:       newTickClock(monotonicSince(time.Now())),
+	}
+	h.health.setState(h.state)
+	metrics.observeHubState(h.state)
+	h.onTransition(func(from, to hubState) {
+		log.Printf("hub %s -> %s", from, to)
+		h.health.setState(to)
+		metrics.observeHubState(to)
+		if to == Running {
+			h.health.setDiscovered()
+		}
+	})
+	return h, nil
+}
+
+func (h *hub) onTransition(hook transitionHook) {
+	h.hooks = append(h.hooks, hook)
+}
+
+func (h *hub) transition(to hubState) {
+	from := h.state
+	if from == to {
+		return
+	}
+	h.state = to
+	for _, hook := range h.hooks {
+		hook(from, to)
+	}
+}
+
+func (h *hub) stop(exitCode int) {
+	h.exitCode = exitCode
+	h.transition(Stopped)
+}
+
+func (h *hub) run() int {
+	for h.state != Stopped {
+		if h.state == Discovering || (h.state == Degraded && h.resumeState == Discovering) {
+			h.discover()
+		} else {
+			h.poll()
+		}
+	}
+	return h.exitCode
+}
+
+func (h *hub) newPacket(dst int, cmd cmd, body CmdBodyBytes) Packet {
+	return h.newPacketAs(SmartHub, dst, cmd, body)
+}
+
+// newPacketAs builds a packet carrying dt, SETSTATUS names the type of the
+// device it is sent to rather than the hub.
+func (h *hub) newPacketAs(dt devType, dst int, cmd cmd, body CmdBodyBytes) Packet {
+	pct := Packet{
+		Length: 0,
+		Payload: Payload{
+			Src:     h.address,
+			Dst:     dst,
+			Serial:  h.serial.allocate(),
+			DevType: dt,
+			Cmd:     cmd,
+			CmdBody: body,
+		},
+		Crc8: 0,
+	}
+	// only the hub loop builds packets, wire is free until the exchange
+	h.wire = h.codec.seal(&pct, h.wire)
+	return pct
+}
+
+// exchange posts batch to the network and decodes the answer. It returns
+// false when there is nothing to handle, the hub state is already updated
+// for transport errors and final statuses.
+func (h *hub) exchange(batch Packets) (*Packets, bool) {
+	h.wire = batch.appendBytes(h.wire[:0])
+	request := base64.RawURLEncoding.EncodeToString(h.wire)
+	metrics.observeSent(batch)
+	body, status, err := h.transport(h.url, request)
+	h.health.roundTrip(status, err)
+	if err != nil {
+		log.Print(err)
+		h.transportError()
+		return nil, false
+	}
+	switch status {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		h.stop(0)
+		return nil, false
+	default:
+		h.stop(99)
+		return nil, false
+	}
+
+	h.transportErrors = 0
+	if h.state == Degraded {
+		h.transition(h.resumeState)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(removeSpaces(string(body)))
+	if err != nil {
+		log.Print(err)
+		metrics.decodeErrors.add(1)
+		return nil, false
+	}
+	pcts := h.codec.packetsFromBytes(data)
+	metrics.observeReceived(*pcts)
+	return pcts, true
+}
+
+func (h *hub) transportError() {
+	h.transportErrors++
+	if h.cfg.StopAfterErrors > 0 && h.transportErrors >= h.cfg.StopAfterErrors {
+		h.stop(99)
+		return
+	}
+	if h.state != Degraded && h.transportErrors >= h.cfg.DegradedAfterErrors {
+		h.resumeState = h.state
+		h.transition(Degraded)
+	}
+	if h.state == Degraded {
+		h.sleep(h.degradedBackoff())
+	}
+}
+
+// degradedBackoff doubles from DegradedBackoff with every error past the
+// one that degraded the hub, up to DegradedMaxBackoff.
+func (h *hub) degradedBackoff() time.Duration {
+	backoff := h.cfg.DegradedBackoff
+	for i := h.cfg.DegradedAfterErrors; i < h.transportErrors && backoff < h.cfg.DegradedMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if h.cfg.DegradedMaxBackoff > 0 && backoff > h.cfg.DegradedMaxBackoff {
+		backoff = h.cfg.DegradedMaxBackoff
+	}
+	return time.Duration(backoff) * time.Millisecond
+}
+
+// discover broadcasts WHOISHERE and registers whoever answers, then asks
+// every EnvSensor for its readings.
+func (h *hub) discover() {
+	pcts, ok := h.exchange(Packets{h.newPacket(OpenProtocol, WHOISHERE, Name{DevName: HubName})})
+	if !ok {
+		return
+	}
+	h.observe(*pcts)
+	h.requestTime[OpenProtocol] = []int{h.hubTime}
+	h.lastWhois = h.hubTime
+
+	h.reg.mu.Lock()
+	h.handler(pcts)
+	if !h.discovered {
+		for _, dev := range h.reg.devices {
+			dev.IsPresent = true
+			dev.Downtimes = nil
+			delete(h.recovery, dev.Address)
+		}
+	}
+	for _, dev := range h.reg.devices {
+		if dev.DevType == EnvSensor && dev.IsPresent {
+			h.queue.push(h.newPacket(dev.Address, GETSTATUS, nil), PriorityPoll)
+		}
+	}
+	h.reg.mu.Unlock()
+
+	h.discovered = true
+	h.transition(Running)
+}
+
+// poll sends the pending commands together with the scheduled polls,
+// expires unanswered requests and handles the answer. Too many devices
+// timing out in one round sends the hub back to discovery.
+func (h *hub) poll() {
+	h.reg.mu.RLock()
+	h.scenes.tick(h.hubTime)
+	for _, act := range h.scenes.drain() {
+		var commands Packets
+		applyTargets(&commands, h.reg.devices, h.scenes, act.names, act.state, h.newPacketAs)
+		for _, pct := range commands {
+			h.queue.push(pct, PriorityUser)
+		}
+	}
+	for _, cmd := range h.commands.drainQueued() {
+		h.sendCommand(cmd)
+	}
+	for _, address := range h.scheduler.due(h.reg.devices, h.hubTime) {
+		h.queue.push(h.newPacket(address, GETSTATUS, nil), PriorityPoll)
+	}
+	h.probeAbsent()
+	h.reg.mu.RUnlock()
+	if h.cfg.RediscoverInterval > 0 && h.hubTime-h.lastWhois >= h.cfg.RediscoverInterval {
+		h.queue.push(h.newPacket(OpenProtocol, WHOISHERE, Name{DevName: HubName}), PriorityProtocol)
+		h.requestTime[OpenProtocol] = []int{h.hubTime}
+		h.lastWhois = h.hubTime
+	}
+
+	batch := h.queue.pop()
+	for _, pct := range batch {
+		curCmd := pct.Payload.Cmd
+		curDst := pct.Payload.Dst
+		if curCmd == GETSTATUS || curCmd == SETSTATUS {
+			h.requestTime[curDst] = append(h.requestTime[curDst], h.hubTime)
+		}
+		if curCmd == SETSTATUS {
+			h.commands.sent(pct, h.hubTime)
+		}
+	}
+
+	pcts, ok := h.exchange(batch)
+	if !ok {
+		return
+	}
+	h.observe(*pcts)
+
+	h.reg.mu.Lock()
+	defer h.reg.mu.Unlock()
+	retried := h.retryCommands()
+	timedOut := 0
+	for address, time := range h.requestTime {
+		if address == OpenProtocol || h.hubTime-time[0] <= 300 {
+			continue
+		}
+		if retried[address] {
+			delete(h.requestTime, address)
+			continue
+		}
+		if dev, ok := h.reg.devices[address]; ok && dev.IsPresent {
+			h.markAbsent(dev, h.hubTime)
+			timedOut++
+		}
+		delete(h.requestTime, address)
+	}
+	h.handler(pcts)
+	h.forget()
+	metrics.observeState(h.reg.devices, h.requestTime, h.serial.peek())
+
+	if h.cfg.RediscoverAfter > 0 && timedOut >= h.cfg.RediscoverAfter {
+		h.transition(Discovering)
+	}
+}
+
+// register stores the device announced by an IAMHERE or WHOISHERE packet.
+// Another device of the same type and name that didn't announce itself in
+// this batch is taken to have moved to the new address, anything else
+// claiming the name is reported as a collision.
+func (h *hub) register(pct Packet, isPresent bool, answerTime int, announced map[int]bool) {
+	address := pct.Payload.Src
+	dev := &Database{
+		Address:   address,
+		DevType:   pct.Payload.DevType,
+		IsPresent: isPresent,
+		Time:      answerTime,
+		LastSeen:  answerTime,
+	}
+	switch body := pct.Payload.CmdBody.(type) {
+	case SwitchDevice:
+		dev.DevName = body.DevName
+		dev.ConnDevs = body.DevProps.DevNames
+	case Sensors:
+		dev.DevName = body.DevName
+		dev.Sensors = body.DevProps.Sensors
+		dev.Triggers = body.DevProps.Triggers
+	case Name:
+		dev.DevName = body.DevName
+	}
+	announced[address] = true
+
+	database := h.reg.devices
+	old, known := database[address]
+	moved := false
+	for _, other := range database {
+		if other.Address == address || other.DevName != dev.DevName {
+			continue
+		}
+		if other.DevType == dev.DevType && !announced[other.Address] {
+			delete(database, other.Address)
+			delete(h.requestTime, other.Address)
+			moved = true
+			h.events.emit(DeviceEvent{
+				Kind:       EventMoved,
+				Address:    address,
+				OldAddress: other.Address,
+				DevName:    dev.DevName,
+				DevType:    dev.DevType,
+				Time:       answerTime,
+			})
+		} else {
+			log.Printf("name %s claimed by both %x and %x", dev.DevName, other.Address, address)
+			h.events.emit(DeviceEvent{
+				Kind:       EventCollision,
+				Address:    address,
+				OldAddress: other.Address,
+				DevName:    dev.DevName,
+				DevType:    dev.DevType,
+				Time:       answerTime,
+			})
+		}
+	}
+
+	if known && old.DevName == dev.DevName && old.DevType == dev.DevType {
+		dev.Status = old.Status
+		dev.StatusKnown = old.StatusKnown
+		dev.Readings = old.Readings
+		dev.Downtimes = old.Downtimes
+		if isPresent && !old.IsPresent {
+			h.markPresent(dev, answerTime)
+		}
+	} else if known {
+		h.events.emit(DeviceEvent{
+			Kind:    EventRenamed,
+			Address: address,
+			DevName: dev.DevName,
+			OldName: old.DevName,
+			DevType: dev.DevType,
+			Time:    answerTime,
+		})
+	} else if !moved {
+		h.events.emit(DeviceEvent{
+			Kind:    EventAdded,
+			Address: address,
+			DevName: dev.DevName,
+			DevType: dev.DevType,
+			Time:    answerTime,
+		})
+	}
+	if !dev.IsPresent && (!known || old.IsPresent) {
+		h.markAbsent(dev, answerTime)
+	}
+	database[address] = dev
+}
+
+// forget drops devices that have been absent for longer than ForgetAfter.
+func (h *hub) forget() {
+	if h.cfg.ForgetAfter <= 0 {
+		return
+	}
+	for address, dev := range h.reg.devices {
+		if dev.IsPresent || h.hubTime-dev.LastSeen <= h.cfg.ForgetAfter {
+			continue
+		}
+		delete(h.reg.devices, address)
+		delete(h.requestTime, address)
+		h.events.emit(DeviceEvent{
+			Kind:    EventRemoved,
+			Address: address,
+			DevName: dev.DevName,
+			DevType: dev.DevType,
+			Time:    h.hubTime,
+		})
+	}
+}
+
+// sendCommand queues a SETSTATUS for cmd, a command for a device that left
+// the registry fails right away.
+func (h *hub) sendCommand(cmd *Command) bool {
+	dev, ok := h.reg.devices[cmd.Address]
+	if !ok {
+		h.commands.fail(cmd, h.hubTime)
+		return false
+	}
+	pct := h.newPacketAs(dev.DevType, dev.Address, SETSTATUS, Value{Value: cmd.State})
+	h.commands.link(cmd, pct.Payload.Serial)
+	h.queue.push(pct, cmd.Priority)
+	return true
+}
+
+// retryCommands sends the expired commands again with a new serial and
+// reports the ones out of retries. It returns the devices being retried,
+// their silence doesn't count as a timeout yet.
+func (h *hub) retryCommands() map[int]bool {
+	retry, failed := h.commands.expire(h.hubTime)
+	retried := make(map[int]bool)
+	for _, cmd := range retry {
+		if h.sendCommand(cmd) {
+			retried[cmd.Address] = true
+		} else {
+			failed = append(failed, cmd)
+		}
+	}
+	for _, cmd := range failed {
+		ev := DeviceEvent{Kind: EventCommandFailed, Address: cmd.Address, Time: h.hubTime}
+		if dev, ok := h.reg.devices[cmd.Address]; ok {
+			ev.DevName = dev.DevName
+			ev.DevType = dev.DevType
+		}
+		h.events.emit(ev)
+	}
+	return retried
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func devicePacket(src, dst, serial int, dt devType, c cmd, body CmdBodyBytes) Packet {
+	pct := Packet{Payload: Payload{Src: src, Dst: dst, Serial: serial, DevType: dt, Cmd: c, CmdBody: body}}
+	pct.seal(nil)
+	return pct
+}
+
+// fakeNetwork answers the hub's rounds with the given batches in order and
+// 204 once they run out.
+func fakeNetwork(rounds ...Packets) *httptest.Server {
+	round := 0
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if round >= len(rounds) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Write([]byte(base64.RawURLEncoding.EncodeToString(rounds[round].toBytes())))
+		round++
+	}))
+}
+
+func TestHubStateMachine(t *testing.T) {
+	network := fakeNetwork(
+		Packets{
+			devicePacket(6, OpenProtocol, 1, Clock, TICK, Timestamp{Timestamp: 1000}),
+			devicePacket(4, 1, 1, Lamp, IAMHERE, Name{DevName: "LAMP01"}),
+		},
+		Packets{
+			devicePacket(6, OpenProtocol, 2, Clock, TICK, Timestamp{Timestamp: 1100}),
+		},
+	)
+	defer network.Close()
+
+	h, err := newHub(defaultConfig(), network.URL, 1)
+	assert.NoError(t, err)
+	var transitions []hubState
+	h.onTransition(func(from, to hubState) {
+		transitions = append(transitions, to)
+	})
+
+	assert.Equal(t, 0, h.run())
+	assert.Equal(t, []hubState{Running, Stopped}, transitions)
+	assert.True(t, h.reg.devices[4].IsPresent)
+	assert.Equal(t, "LAMP01", h.reg.devices[4].DevName)
+}
+
+func TestHubDegradedOnTransportErrors(t *testing.T) {
+	network := fakeNetwork()
+	url := network.URL
+	network.Close()
+
+	cfg := defaultConfig()
+	cfg.DegradedAfterErrors = 2
+	cfg.StopAfterErrors = 4
+	cfg.DegradedBackoff = 100
+	cfg.DegradedMaxBackoff = 150
+	h, err := newHub(cfg, url, 1)
+	assert.NoError(t, err)
+	var slept []time.Duration
+	h.sleep = func(d time.Duration) { slept = append(slept, d) }
+	var transitions []hubState
+	h.onTransition(func(from, to hubState) {
+		transitions = append(transitions, to)
+	})
+
+	assert.Equal(t, 99, h.run())
+	assert.Equal(t, []hubState{Degraded, Stopped}, transitions)
+	assert.Equal(t, 4, h.transportErrors)
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 150 * time.Millisecond}, slept)
+}
+
+func TestHubRegisterHotPlug(t *testing.T) {
+	h, err := newHub(defaultConfig(), "", 1)
+	assert.NoError(t, err)
+	h.requestTime[OpenProtocol] = []int{1000}
+	kinds := func() []string {
+		var kinds []string
+		for _, ev := range h.events.since(0) {
+			kinds = append(kinds, ev.Kind)
+		}
+		return kinds
+	}
+
+	h.handler(&Packets{
+		devicePacket(4, 1, 1, Lamp, IAMHERE, Name{DevName: "LAMP01"}),
+		devicePacket(5, 1, 1, Socket, IAMHERE, Name{DevName: "SOCKET01"}),
+	})
+	assert.Equal(t, []string{EventAdded, EventAdded}, kinds())
+
+	h.reg.devices[4].Status = true
+	h.handler(&Packets{devicePacket(4, 1, 2, Lamp, IAMHERE, Name{DevName: "LAMP01"})})
+	assert.True(t, h.reg.devices[4].Status)
+	assert.Len(t, kinds(), 2)
+
+	h.handler(&Packets{devicePacket(7, 1, 1, Lamp, IAMHERE, Name{DevName: "LAMP01"})})
+	assert.Equal(t, EventMoved, kinds()[2])
+	assert.NotContains(t, h.reg.devices, 4)
+
+	h.handler(&Packets{
+		devicePacket(5, 1, 2, Socket, IAMHERE, Name{DevName: "SOCKET02"}),
+		devicePacket(8, 1, 1, Socket, IAMHERE, Name{DevName: "SOCKET02"}),
+	})
+	assert.Equal(t, []string{EventRenamed, EventCollision, EventAdded}, kinds()[3:])
+	assert.Len(t, h.reg.devices, 3)
+}
+
+func TestHubPresenceRecovery(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.RecoveryBackoff = 100
+	cfg.RecoveryMaxBackoff = 300
+	h, err := newHub(cfg, "", 1)
+	assert.NoError(t, err)
+	h.requestTime[OpenProtocol] = []int{0}
+	h.handler(&Packets{devicePacket(4, 1, 1, Lamp, IAMHERE, Name{DevName: "LAMP01"})})
+	lamp := h.reg.devices[4]
+
+	h.hubTime = 1000
+	h.markAbsent(lamp, h.hubTime)
+	snapshot, _ := h.reg.device(4)
+	probes := func() int {
+		h.probeAbsent()
+		return len(h.queue.pop())
+	}
+	assert.Equal(t, 0, probes())
+	h.hubTime = 1100
+	assert.Equal(t, 1, probes())
+	h.hubTime = 1250
+	assert.Equal(t, 0, probes())
+	h.hubTime = 1300
+	assert.Equal(t, 1, probes())
+	assert.Equal(t, 300, h.recovery[4].backoff)
+
+	h.handler(&Packets{
+		devicePacket(6, OpenProtocol, 1, Clock, TICK, Timestamp{Timestamp: 1400}),
+		devicePacket(4, 1, 2, Lamp, STATUS, Value{Value: 1}),
+	})
+	assert.True(t, lamp.IsPresent)
+	assert.True(t, lamp.Status)
+	assert.Equal(t, []Downtime{{From: 1000, To: 1400}}, lamp.Downtimes)
+	assert.Empty(t, h.recovery)
+	// the API's copy does not share the interval closed under it
+	assert.Equal(t, []Downtime{{From: 1000}}, snapshot.Downtimes)
+}
+
+func TestHubCommandRetries(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.CommandRetries = 1
+	h, err := newHub(cfg, "", 1)
+	assert.NoError(t, err)
+	h.requestTime[OpenProtocol] = []int{0}
+	h.handler(&Packets{devicePacket(4, 1, 1, Lamp, IAMHERE, Name{DevName: "LAMP01"})})
+	send := func() Packets {
+		batch := h.queue.pop()
+		for _, pct := range batch {
+			h.commands.sent(pct, h.hubTime)
+		}
+		return batch
+	}
+
+	cmd := h.commands.request(4, 1)
+	for _, queued := range h.commands.drainQueued() {
+		h.sendCommand(queued)
+	}
+	first := send()
+	assert.Len(t, first, 1)
+	assert.Equal(t, Lamp, first[0].Payload.DevType)
+
+	h.hubTime = 400
+	assert.Equal(t, map[int]bool{4: true}, h.retryCommands())
+	second := send()
+	assert.Len(t, second, 1)
+	assert.NotEqual(t, first[0].Payload.Serial, second[0].Payload.Serial)
+	got, _ := h.commands.get(cmd.ID)
+	assert.Equal(t, CommandPending, got.Status)
+	assert.Equal(t, 2, got.Attempts)
+
+	h.hubTime = 800
+	assert.Empty(t, h.retryCommands())
+	got, _ = h.commands.get(cmd.ID)
+	assert.Equal(t, CommandFailed, got.Status)
+	assert.Equal(t, EventCommandFailed, h.events.since(1)[0].Kind)
+
+	confirmed := h.commands.request(4, 0)
+	for _, queued := range h.commands.drainQueued() {
+		h.sendCommand(queued)
+	}
+	send()
+	h.handler(&Packets{
+		devicePacket(6, OpenProtocol, 1, Clock, TICK, Timestamp{Timestamp: 900}),
+		devicePacket(4, 1, 2, Lamp, STATUS, Value{Value: 0}),
+	})
+	got, _ = h.commands.get(confirmed.ID)
+	assert.Equal(t, CommandConfirmed, got.Status)
+}
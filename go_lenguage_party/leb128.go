@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+var (
+	errLEB128Truncated = errors.New("leb128: truncated encoding")
+	errLEB128Overflow  = errors.New("leb128: value overflows 64 bits")
+	errLEB128Overlong  = errors.New("leb128: over-long encoding")
+)
+
+// maxLEB128Len is the longest encoding of a 64-bit value.
+const maxLEB128Len = 10
+
+func appendULEB128u64(dst []byte, value uint64) []byte {
+	for value >= 0x80 {
+		dst = append(dst, byte(value)|0x80)
+		value >>= 7
+	}
+	return append(dst, byte(value))
+}
+
+// decodeULEB128u64 reads one unsigned value from the front of bytes and
+// reports how many bytes it took. Only the minimal encoding is accepted.
+func decodeULEB128u64(bytes []byte) (uint64, int, error) {
+	var res uint64
+	for i, bt := range bytes {
+		if i == maxLEB128Len-1 && bt > 0x01 {
+			return 0, 0, errLEB128Overflow
+		}
+		res |= uint64(bt&0x7f) << (7 * i)
+		if bt&0x80 == 0 {
+			if bt == 0 && i > 0 {
+				return 0, 0, errLEB128Overlong
+			}
+			return res, i + 1, nil
+		}
+	}
+	return 0, 0, errLEB128Truncated
+}
+
+// decodeULEB128 decodes the protocol's unsigned fields into an int, values
+// past math.MaxInt64 are an overflow.
+func decodeULEB128(bytes []byte) (int, int, error) {
+	value, skip, err := decodeULEB128u64(bytes)
+	if err != nil {
+		return 0, 0, err
+	}
+	if value > math.MaxInt64 {
+		return 0, 0, errLEB128Overflow
+	}
+	return int(value), skip, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestULEB128u64(t *testing.T) {
+	cases := []struct {
+		value   uint64
+		encoded []byte
+	}{
+		{0, []byte{0x00}},
+		{0x7F, []byte{0x7F}},
+		{0x80, []byte{0x80, 0x01}},
+		{624485, []byte{0xE5, 0x8E, 0x26}},
+		{uint64(OpenProtocol), []byte{0xFF, 0x7F}},
+		{math.MaxUint64, []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.encoded, appendULEB128u64(nil, c.value))
+		value, skip, err := decodeULEB128u64(append(c.encoded, 0xAA))
+		assert.NoError(t, err)
+		assert.Equal(t, c.value, value)
+		assert.Equal(t, len(c.encoded), skip)
+	}
+}
+
+func TestULEB128u64Errors(t *testing.T) {
+	_, _, err := decodeULEB128u64(nil)
+	assert.Equal(t, errLEB128Truncated, err)
+	_, _, err = decodeULEB128u64([]byte{0x80, 0x80})
+	assert.Equal(t, errLEB128Truncated, err)
+	_, _, err = decodeULEB128u64([]byte{0x80, 0x00})
+	assert.Equal(t, errLEB128Overlong, err)
+	_, _, err = decodeULEB128u64([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x02})
+	assert.Equal(t, errLEB128Overflow, err)
+	_, _, err = decodeULEB128u64([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x81, 0x00})
+	assert.Equal(t, errLEB128Overflow, err)
+}
+
+func TestULEB128RejectsNegative(t *testing.T) {
+	assert.Panics(t, func() { encodeULEB128(-1) })
+	assert.Panics(t, func() { devicePacket(-1, OpenProtocol, 1, SmartHub, WHOISHERE, Name{DevName: HubName}) })
+	_, _, err := decodeULEB128(appendULEB128u64(nil, math.MaxUint64))
+	assert.Equal(t, errLEB128Overflow, err)
+
+	_, err = newHub(defaultConfig(), "", -1)
+	assert.Error(t, err)
+	_, err = newHub(defaultConfig(), "", OpenProtocol)
+	assert.Error(t, err)
+}
+
+func TestTickRejectsOverlongTimestamp(t *testing.T) {
+	assert.Nil(t, parsedCMDBody(Clock, TICK, []byte{0x85, 0x80, 0x00}))
+	assert.Equal(t, Timestamp{Timestamp: 5}, parsedCMDBody(Clock, TICK, []byte{0x05}))
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
@@ -9,6 +8,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 )
 
@@ -44,6 +44,7 @@ const (
 
 type CmdBodyBytes interface {
 	toBytes() []byte
+	appendBytes(dst []byte) []byte
 }
 
 func getConnectiongString(url string) string {
@@ -74,22 +75,41 @@ type Payload struct {
 }
 
 func (pld Payload) toBytes() []byte {
-	byteArray := make([]byte, 0)
-	byteArray = append(byteArray, encodeULEB128(pld.Src)...)
-	byteArray = append(byteArray, encodeULEB128(pld.Dst)...)
-	byteArray = append(byteArray, encodeULEB128(pld.Serial)...)
-	byteArray = append(byteArray, []byte{byte(pld.DevType), byte(pld.Cmd)}...)
+	return pld.appendBytes(nil)
+}
+
+// appendBytes encodes the payload onto the end of dst, it allocates only
+// when dst runs out of capacity.
+func (pld Payload) appendBytes(dst []byte) []byte {
+	dst = appendULEB128(dst, pld.Src)
+	dst = appendULEB128(dst, pld.Dst)
+	dst = appendULEB128(dst, pld.Serial)
+	dst = append(dst, byte(pld.DevType), byte(pld.Cmd))
 	if pld.CmdBody != nil {
-		byteArray = append(byteArray, (pld.CmdBody).toBytes()...)
+		dst = pld.CmdBody.appendBytes(dst)
 	}
-	return byteArray
+	return dst
 }
 
+// payloadFromBytes returns nil when the addresses or the serial are not
+// valid ULEB128 or the header is cut short.
 func payloadFromBytes(bytes []byte) *Payload {
-	srcULEB, skipFirst := decodeULEB128(bytes)
-	dstULEB, skipSecond := decodeULEB128(bytes[skipFirst:])
-	serialULEB, skipThird := decodeULEB128(bytes[skipFirst+skipSecond:])
+	srcULEB, skipFirst, err := decodeULEB128(bytes)
+	if err != nil {
+		return nil
+	}
+	dstULEB, skipSecond, err := decodeULEB128(bytes[skipFirst:])
+	if err != nil {
+		return nil
+	}
+	serialULEB, skipThird, err := decodeULEB128(bytes[skipFirst+skipSecond:])
+	if err != nil {
+		return nil
+	}
 	payload := skipFirst + skipSecond + skipThird
+	if len(bytes) < payload+2 {
+		return nil
+	}
 	pld := Payload{
 		Src:     srcULEB,
 		Dst:     dstULEB,
@@ -114,85 +134,119 @@ type Packet struct {
 }
 
 func (pact Packet) toBytes() []byte {
-	byteArray := make([]byte, 0)
-	byteArray = append(byteArray, pact.Length)
-	byteArray = append(byteArray, pact.Payload.toBytes()...)
-	byteArray = append(byteArray, pact.Crc8)
-	return byteArray
+	return pact.appendBytes(nil)
+}
+
+func (pact Packet) appendBytes(dst []byte) []byte {
+	dst = append(dst, pact.Length)
+	dst = pact.Payload.appendBytes(dst)
+	return append(dst, pact.Crc8)
+}
+
+// seal fills in Length and Crc8 from a single encoding of the payload into
+// buf and returns buf for reuse, it allocates only when buf is too small.
+func (c codec) seal(pact *Packet, buf []byte) []byte {
+	data := pact.Payload.appendBytes(buf[:0])
+	pact.Length = byte(len(data))
+	pact.Crc8 = c.crc.checksum(data)
+	return data
+}
+
+func (pact *Packet) seal(buf []byte) []byte {
+	return defaultCodec.seal(pact, buf)
 }
 
-func packetFromBytes(bytes []byte) (*Packet, int) {
+// packetFactory builds a sealed packet from the hub, see hub.newPacketAs.
+type packetFactory func(dt devType, dst int, cmd cmd, body CmdBodyBytes) Packet
+
+// packetFromBytes decodes the frame at the front of bytes. A frame whose
+// crc8 or payload is bad is skipped with a nil packet, one cut short by the
+// end of the batch is an error since nothing after it can be framed.
+func (c codec) packetFromBytes(bytes []byte) (*Packet, int, error) {
+	if len(bytes) < 1 || len(bytes) < int(bytes[0])+2 {
+		return nil, 0, fmt.Errorf("truncated packet: %d bytes left", len(bytes))
+	}
 	dataLength := bytes[0]
-	data := bytes[1 : dataLength+1]
-	crc8 := bytes[dataLength+1]
-	crc8cmp := computeCRC8Simple(data)
+	// int arithmetic, dataLength+1 overflows a byte for 0xFF
+	data := bytes[1 : int(dataLength)+1]
+	crc8 := bytes[int(dataLength)+1]
+	crc8cmp := c.crc.checksum(data)
 
 	if crc8 != crc8cmp {
-		log.Fatal("control sum mismatched")
+		log.Print("control sum mismatched")
+		metrics.crcFailures.add(1)
+		return nil, int(dataLength) + 2, nil
 	}
 	pld := payloadFromBytes(data)
+	if pld == nil {
+		log.Print("malformed payload")
+		metrics.decodeErrors.add(1)
+		return nil, int(dataLength) + 2, nil
+	}
 	pct := Packet{
 		Length:  dataLength,
 		Payload: *pld,
 		Crc8:    crc8,
 	}
-	return &pct, int(dataLength) + 2
+	return &pct, int(dataLength) + 2, nil
 }
 
 type Packets []Packet
 
 func (pcts Packets) toBytes() []byte {
-	byteArray := make([]byte, 0)
+	return pcts.appendBytes(nil)
+}
+
+func (pcts Packets) appendBytes(dst []byte) []byte {
 	for _, pct := range pcts {
-		byteArray = append(byteArray, pct.toBytes()...)
+		dst = pct.appendBytes(dst)
 	}
-	return byteArray
+	return dst
 }
 
-func packetsFromBytes(bytes []byte) *Packets {
+func packetFromBytes(bytes []byte) (*Packet, int, error) {
+	return defaultCodec.packetFromBytes(bytes)
+}
+
+func (c codec) packetsFromBytes(bytes []byte) *Packets {
 	length := len(bytes)
 	skip := 0
 	var pcts Packets
 	for skip < length {
-		pct, nowSkip := packetFromBytes(bytes[skip:])
+		pct, nowSkip, err := c.packetFromBytes(bytes[skip:])
+		if err != nil {
+			log.Print(err)
+			metrics.decodeErrors.add(1)
+			break
+		}
 		skip += nowSkip
-		pcts = append(pcts, *pct)
+		if pct != nil {
+			pcts = append(pcts, *pct)
+		}
 	}
 	return &pcts
 }
 
+func packetsFromBytes(bytes []byte) *Packets {
+	return defaultCodec.packetsFromBytes(bytes)
+}
+
 func encodeULEB128(value int) []byte {
-	var res []byte
-	for {
-		bt := byte(value & 0x7f)
-		value >>= 7
-		if value != 0 {
-			bt |= 0x80
-		}
-		res = append(res, bt)
-		if value == 0 {
-			break
-		}
-	}
-	return res
+	return appendULEB128(nil, value)
 }
 
-func decodeULEB128(bytes []byte) (int, int) {
-	res := 0
-	shift := 0
-	byteParsed := 0
-	for _, bt := range bytes {
-		byteParsed++
-		res |= (int(bt) & 0x7f) << shift
-		shift += 7
-		if bt&0x80 == 0 {
-			break
-		}
+// appendULEB128 encodes one of the protocol's unsigned fields. None of them
+// can be negative, so a negative value is a bug in the caller and panics
+// rather than going out as a 10-byte varint no decoder accepts.
+func appendULEB128(dst []byte, value int) []byte {
+	if value < 0 {
+		panic(fmt.Sprintf("leb128: negative value %d for an unsigned field", value))
 	}
-
-	return res, byteParsed
+	return appendULEB128u64(dst, uint64(value))
 }
 
+// computeCRC8Simple is the bitwise reference for the default variant, the
+// codec goes through the table in crc8.go.
 func computeCRC8Simple(bytes []byte) byte {
 	const generator byte = 0x1D
 	crc := byte(0)
@@ -214,8 +268,12 @@ type Name struct {
 }
 
 func (name Name) toBytes() []byte {
-	byteArr := []byte{byte(len(name.DevName))}
-	return append(byteArr, []byte(name.DevName)...)
+	return name.appendBytes(nil)
+}
+
+func (name Name) appendBytes(dst []byte) []byte {
+	dst = append(dst, byte(len(name.DevName)))
+	return append(dst, name.DevName...)
 }
 
 type Sensor struct {
@@ -223,11 +281,15 @@ type Sensor struct {
 }
 
 func (sen Sensor) toBytes() []byte {
-	byteArr := []byte{byte(len(sen.Values))}
+	return sen.appendBytes(nil)
+}
+
+func (sen Sensor) appendBytes(dst []byte) []byte {
+	dst = append(dst, byte(len(sen.Values)))
 	for _, value := range sen.Values {
-		byteArr = append(byteArr, encodeULEB128(value)...)
+		dst = appendULEB128(dst, value)
 	}
-	return byteArr
+	return dst
 }
 
 type Sensors struct {
@@ -236,23 +298,22 @@ type Sensors struct {
 }
 
 func (sen Sensors) toBytes() []byte {
-	nameLen := byte(len(sen.DevName))
-	name := []byte(sen.DevName)
-	sensors := sen.DevProps.Sensors
-	triggerLen := len(sen.DevProps.Triggers)
-	byteArr := []byte{nameLen}
-	byteArr = append(byteArr, name...)
-	byteArr = append(byteArr, []byte{sensors, byte(triggerLen)}...)
+	return sen.appendBytes(nil)
+}
 
-	for i := 0; i < triggerLen; i++ {
-		bytes := []byte{sen.DevProps.Triggers[i].Op}
-		bytes = append(bytes, encodeULEB128(sen.DevProps.Triggers[i].Value)...)
-		bytes = append(bytes, byte(len(sen.DevProps.Triggers[i].Name)))
-		bytes = append(bytes, []byte(sen.DevProps.Triggers[i].Name)...)
-		byteArr = append(byteArr, bytes...)
+func (sen Sensors) appendBytes(dst []byte) []byte {
+	dst = append(dst, byte(len(sen.DevName)))
+	dst = append(dst, sen.DevName...)
+	dst = append(dst, sen.DevProps.Sensors, byte(len(sen.DevProps.Triggers)))
+
+	for _, trigger := range sen.DevProps.Triggers {
+		dst = append(dst, trigger.Op)
+		dst = appendULEB128(dst, trigger.Value)
+		dst = append(dst, byte(len(trigger.Name)))
+		dst = append(dst, trigger.Name...)
 	}
 
-	return byteArr
+	return dst
 }
 
 type SwitchDevice struct {
@@ -265,18 +326,19 @@ type DevProps struct {
 }
 
 func (swtd SwitchDevice) toBytes() []byte {
-	devNameLen := byte(len(swtd.DevName))
-	devName := []byte(swtd.DevName)
-	devPropsLen := byte(len(swtd.DevProps.DevNames))
-	byteArr := []byte{devNameLen}
-	byteArr = append(byteArr, devName...)
-	byteArr = append(byteArr, devPropsLen)
+	return swtd.appendBytes(nil)
+}
+
+func (swtd SwitchDevice) appendBytes(dst []byte) []byte {
+	dst = append(dst, byte(len(swtd.DevName)))
+	dst = append(dst, swtd.DevName...)
+	dst = append(dst, byte(len(swtd.DevProps.DevNames)))
 
 	for _, devName := range swtd.DevProps.DevNames {
-		byteArr = append(byteArr, byte(len(devName)))
-		byteArr = append(byteArr, []byte(devName)...)
+		dst = append(dst, byte(len(devName)))
+		dst = append(dst, devName...)
 	}
-	return byteArr
+	return dst
 }
 
 type Value struct {
@@ -284,7 +346,11 @@ type Value struct {
 }
 
 func (val Value) toBytes() []byte {
-	return []byte{val.Value}
+	return val.appendBytes(nil)
+}
+
+func (val Value) appendBytes(dst []byte) []byte {
+	return append(dst, val.Value)
 }
 
 type Timestamp struct {
@@ -292,14 +358,35 @@ type Timestamp struct {
 }
 
 func (tmp Timestamp) toBytes() []byte {
-	return encodeULEB128(tmp.Timestamp)
+	return tmp.appendBytes(nil)
+}
+
+func (tmp Timestamp) appendBytes(dst []byte) []byte {
+	return appendULEB128(dst, tmp.Timestamp)
+}
+
+// RawBody keeps the body of a (devType, cmd) pair the codec does not know
+// so the packet encodes back to the same bytes.
+type RawBody struct {
+	Bytes []byte `json:"bytes"`
 }
 
+func (raw RawBody) toBytes() []byte {
+	return raw.appendBytes(nil)
+}
+
+func (raw RawBody) appendBytes(dst []byte) []byte {
+	return append(dst, raw.Bytes...)
+}
+
+// findTime returns the time of the first well-formed TICK in pcts or -1,
+// it runs before validation so a TICK without a Timestamp is skipped.
 func findTime(pcts Packets) int {
 	for _, pct := range pcts {
 		if pct.Payload.DevType == Clock && pct.Payload.Cmd == TICK {
-			clockBody := pct.Payload.CmdBody.(Timestamp)
-			return clockBody.Timestamp
+			if clockBody, ok := pct.Payload.CmdBody.(Timestamp); ok {
+				return clockBody.Timestamp
+			}
 		}
 	}
 	return -1
@@ -316,24 +403,42 @@ type Trigger struct {
 	Name  string `json:"name"`
 }
 
+// parsedCMDBody decodes the body of a (device, cmd) pair, a body too short
+// for what it announces decodes to nil.
 func parsedCMDBody(device devType, cmd cmd, cmdBodyBytes []byte) CmdBodyBytes {
+	length := len(cmdBodyBytes)
 	if (device == Socket || device == SmartHub || device == Lamp || device == Clock) && (cmd == WHOISHERE || cmd == IAMHERE) {
-		nameLength := cmdBodyBytes[0]
+		if length < 1 || length < int(cmdBodyBytes[0])+1 {
+			return nil
+		}
+		nameLength := int(cmdBodyBytes[0])
 		name := cmdBodyBytes[1 : nameLength+1]
 		return Name{string(name)}
 	} else if device == EnvSensor && (cmd == WHOISHERE || cmd == IAMHERE) {
-		nameLength := cmdBodyBytes[0]
+		if length < 1 || length < int(cmdBodyBytes[0])+3 {
+			return nil
+		}
+		nameLength := int(cmdBodyBytes[0])
 		name := cmdBodyBytes[1 : nameLength+1]
 		sensors := cmdBodyBytes[nameLength+1]
-		triggerLength := cmdBodyBytes[nameLength+2]
+		triggerLength := int(cmdBodyBytes[nameLength+2])
 		triggers := make([]Trigger, triggerLength)
-		skip := int(nameLength) + 3
+		skip := nameLength + 3
 
-		for i := 0; i < int(triggerLength); i++ {
+		for i := 0; i < triggerLength; i++ {
+			if skip >= length {
+				return nil
+			}
 			op := cmdBodyBytes[skip]
 			skip++
-			value, skipULEB := decodeULEB128(cmdBodyBytes[skip:])
+			value, skipULEB, err := decodeULEB128(cmdBodyBytes[skip:])
+			if err != nil || skip+skipULEB >= length {
+				return nil
+			}
 			nameLen := int(cmdBodyBytes[skip+skipULEB])
+			if skip+skipULEB+1+nameLen > length {
+				return nil
+			}
 			nameDevice := string(cmdBodyBytes[skip+skipULEB+1 : skip+skipULEB+1+nameLen])
 			skip += skipULEB + nameLen + 1
 			triggers[i] = Trigger{
@@ -352,25 +457,40 @@ func parsedCMDBody(device devType, cmd cmd, cmdBodyBytes []byte) CmdBodyBytes {
 	} else if (device == Switch || device == EnvSensor || device == Lamp || device == Socket) && cmd == GETSTATUS {
 		return nil
 	} else if device == EnvSensor && cmd == STATUS {
+		if length < 1 {
+			return nil
+		}
 		valueSize := int(cmdBodyBytes[0])
 		values := make([]int, valueSize)
 		skip := 1
 
 		for i := 0; i < valueSize; i++ {
-			value, skipULEB := decodeULEB128(cmdBodyBytes[skip:])
+			if skip >= length {
+				return nil
+			}
+			value, skipULEB, err := decodeULEB128(cmdBodyBytes[skip:])
+			if err != nil {
+				return nil
+			}
 			values[i] = value
 			skip += skipULEB
 		}
 		return Sensor{Values: values}
 	} else if device == Switch && (cmd == WHOISHERE || cmd == IAMHERE) {
-		nameLength := cmdBodyBytes[0]
+		if length < 1 || length < int(cmdBodyBytes[0])+2 {
+			return nil
+		}
+		nameLength := int(cmdBodyBytes[0])
 		name := cmdBodyBytes[1 : nameLength+1]
 		devNamesLen := int(cmdBodyBytes[nameLength+1])
 		devNames := make([]string, devNamesLen)
 		skip := nameLength + 2
 
 		for i := 0; i < devNamesLen; i++ {
-			nameLen := cmdBodyBytes[skip]
+			if skip >= length || skip+1+int(cmdBodyBytes[skip]) > length {
+				return nil
+			}
+			nameLen := int(cmdBodyBytes[skip])
 			nameDevice := cmdBodyBytes[skip+1 : skip+1+nameLen]
 			devNames[i] = string(nameDevice)
 			skip += nameLen + 1
@@ -383,11 +503,22 @@ func parsedCMDBody(device devType, cmd cmd, cmdBodyBytes []byte) CmdBodyBytes {
 		}
 	} else if ((device == Switch || device == Lamp || device == Socket) && cmd == STATUS) ||
 		((device == Lamp || device == Socket) && cmd == SETSTATUS) {
+		if length < 1 {
+			return nil
+		}
 		value := cmdBodyBytes[0]
 		return Value{Value: value}
 	} else if device == Clock && cmd == TICK {
-		time, _ := decodeULEB128(cmdBodyBytes[:])
+		if length < 1 {
+			return nil
+		}
+		time, _, err := decodeULEB128(cmdBodyBytes[:])
+		if err != nil {
+			return nil
+		}
 		return Timestamp{Timestamp: time}
+	} else if !knownPair(device, cmd) && length > 0 {
+		return RawBody{Bytes: append([]byte(nil), cmdBodyBytes...)}
 	}
 	return nil
 }
@@ -408,13 +539,16 @@ func requestServer(url, request string) ([]byte, int, error) {
 	if err != nil {
 		return []byte{}, http.StatusBadRequest, err
 	}
+	start := time.Now()
 	responce, err := client.Do(req)
-	defer responce.Body.Close()
 	if err != nil {
+		metrics.observeRoundTrip(start, 0, err)
 		return []byte{}, http.StatusBadRequest, err
 	}
+	defer responce.Body.Close()
 	body, err := io.ReadAll(responce.Body)
 	status := responce.StatusCode
+	metrics.observeRoundTrip(start, status, err)
 	if err != nil {
 		return []byte{}, http.StatusBadRequest, err
 	}
@@ -422,188 +556,72 @@ func requestServer(url, request string) ([]byte, int, error) {
 }
 
 type Database struct {
-	Address      int       `json:"address"`
-	DevName      string    `json:"dev_name"`
-	DevType      devType   `json:"dev_type"`
-	Status       bool      `json:"status"`
-	IsPresent    bool      `json:"is_present"`
-	ConnDevs     []string  `json:"conn_devs"`
-	SensorValues []int     `json:"sensor_values"`
-	Sensors      byte      `json:"sensors"`
-	Triggers     []Trigger `json:"triggers"`
-	Time         int       `json:"time"`
-}
-
-func setState(pcts *Packets, database map[int]*Database, devices []string, state byte, src int, serial *int) {
+	Address     int        `json:"address"`
+	DevName     string     `json:"dev_name"`
+	DevType     devType    `json:"dev_type"`
+	Status      bool       `json:"status"`
+	StatusKnown bool       `json:"status_known"`
+	IsPresent   bool       `json:"is_present"`
+	ConnDevs    []string   `json:"conn_devs"`
+	Readings    Readings   `json:"readings"`
+	Sensors     byte       `json:"sensors"`
+	Triggers    []Trigger  `json:"triggers"`
+	Time        int        `json:"time"`
+	LastSeen    int        `json:"last_seen"`
+	Downtimes   []Downtime `json:"downtimes"`
+}
+
+func setState(pcts *Packets, database map[int]*Database, devices []string, state byte, newPacket packetFactory) {
 	for _, item := range database {
 		name := item.DevName
 		for _, dev := range devices {
 			if name == dev {
 				var cmdBody CmdBodyBytes = Value{Value: state}
-				newPacket := Packet{
-					Length: 0,
-					Payload: Payload{
-						Src:     src,
-						Dst:     item.Address,
-						Serial:  *serial,
-						DevType: item.DevType,
-						Cmd:     SETSTATUS,
-						CmdBody: cmdBody,
-					},
-					Crc8: 0,
-				}
-				*serial++
-				newPacket.Crc8 = computeCRC8Simple(newPacket.Payload.toBytes())
-				newPacket.Length = byte(len(newPacket.Payload.toBytes()))
-				*pcts = append(*pcts, newPacket)
+				*pcts = append(*pcts, newPacket(item.DevType, item.Address, SETSTATUS, cmdBody))
 				break
 			}
 		}
 	}
 }
 
-func payloadSwitches(pcts *Packets, database map[int]*Database, src int, serial *int) {
-	for _, dev := range database {
-		if dev.DevType == Switch && dev.IsPresent {
-			newPacket := Packet{
-				Length: 0,
-				Payload: Payload{
-					Src:     src,
-					Dst:     dev.Address,
-					Serial:  *serial,
-					DevType: SmartHub,
-					Cmd:     GETSTATUS,
-					CmdBody: nil,
-				},
-				Crc8: 0,
-			}
-			*serial++
-			newPacket.Crc8 = computeCRC8Simple(newPacket.Payload.toBytes())
-			newPacket.Length = byte(len(newPacket.Payload.toBytes()))
-			*pcts = append(*pcts, newPacket)
-		}
-	}
-}
-
-func handler(database map[int]*Database, requestTime map[int][]int, pcts, tasks *Packets, src int, serial *int) {
-	answerTime := findTime(*pcts)
+func (h *hub) handler(pcts *Packets) {
+	database := h.reg.devices
+	history, engine, overrides, scenes := h.history, h.engine, h.overrides, h.scenes
+	requestTime, tasks, newPacket := h.requestTime, &Packets{}, h.newPacketAs
+	announced := make(map[int]bool)
+	answerTime := h.batchTime(*pcts)
 	for _, pct := range *pcts {
-		val, ok := database[pct.Payload.Src]
-		if ok && !val.IsPresent && pct.Payload.Cmd != WHOISHERE {
+		if !knownPair(pct.Payload.DevType, pct.Payload.Cmd) {
+			h.passthrough(pct)
 			continue
 		}
-		if pct.Payload.Cmd == IAMHERE {
-			devt := pct.Payload.DevType
-			adress := pct.Payload.Src
-			isAlive := answerTime-requestTime[OpenProtocol][0] <= 300
-
-			if devt == Switch {
-				body := pct.Payload.CmdBody.(SwitchDevice)
-				database[adress] = &Database{
-					Address:      adress,
-					DevName:      body.DevName,
-					DevType:      pct.Payload.DevType,
-					Status:       false,
-					IsPresent:    isAlive,
-					ConnDevs:     body.DevProps.DevNames,
-					SensorValues: nil,
-					Sensors:      0,
-					Triggers:     nil,
-					Time:         answerTime,
-				}
-			} else if devt == EnvSensor {
-				body := pct.Payload.CmdBody.(Sensors)
-				database[adress] = &Database{
-					Address:      adress,
-					DevName:      body.DevName,
-					DevType:      pct.Payload.DevType,
-					Status:       false,
-					IsPresent:    isAlive,
-					ConnDevs:     nil,
-					SensorValues: nil,
-					Sensors:      body.DevProps.Sensors,
-					Triggers:     body.DevProps.Triggers,
-					Time:         answerTime,
-				}
-			} else {
-				body := pct.Payload.CmdBody.(Name)
-				database[adress] = &Database{
-					Address:      adress,
-					DevName:      body.DevName,
-					DevType:      pct.Payload.DevType,
-					Status:       false,
-					IsPresent:    isAlive,
-					ConnDevs:     nil,
-					SensorValues: nil,
-					Sensors:      0,
-					Triggers:     nil,
-					Time:         answerTime,
-				}
+		if reason := h.validate(pct); reason != "" {
+			h.reject(pct, reason)
+			continue
+		}
+		if h.replays.replayed(pct) {
+			metrics.replaysDropped.add(1)
+			continue
+		}
+		val, ok := database[pct.Payload.Src]
+		if ok && !val.IsPresent && pct.Payload.Cmd != WHOISHERE && pct.Payload.Cmd != IAMHERE {
+			if !h.cfg.RecoveryEnabled || pct.Payload.Cmd != STATUS {
+				continue
 			}
+			h.markPresent(val, answerTime)
+		}
+		if ok {
+			val.LastSeen = answerTime
+		}
+		if pct.Payload.Cmd == IAMHERE {
+			broadcast, ok := requestTime[OpenProtocol]
+			isAlive := ok && answerTime-broadcast[0] <= 300
+			h.register(pct, isAlive, answerTime, announced)
 		} else if pct.Payload.Cmd == WHOISHERE {
 			var cmdBody CmdBodyBytes = Name{DevName: HubName}
-			newPacket := Packet{
-				Length: 0,
-				Payload: Payload{
-					Src:     src,
-					Dst:     OpenProtocol,
-					Serial:  *serial,
-					DevType: SmartHub,
-					Cmd:     IAMHERE,
-					CmdBody: cmdBody,
-				},
-				Crc8: 0,
-			}
-			*serial++
-			newPacket.Crc8 = computeCRC8Simple(newPacket.Payload.toBytes())
-			newPacket.Length = byte(len(newPacket.Payload.toBytes()))
-			*tasks = append(*tasks, newPacket)
-
-			devt := pct.Payload.DevType
-			adress := pct.Payload.Src
-			if devt == Switch {
-				body := pct.Payload.CmdBody.(SwitchDevice)
-				database[adress] = &Database{
-					Address:      adress,
-					DevName:      body.DevName,
-					DevType:      pct.Payload.DevType,
-					Status:       false,
-					IsPresent:    true,
-					ConnDevs:     body.DevProps.DevNames,
-					SensorValues: nil,
-					Sensors:      0,
-					Triggers:     nil,
-					Time:         answerTime,
-				}
-			} else if devt == EnvSensor {
-				body := pct.Payload.CmdBody.(Sensors)
-				database[adress] = &Database{
-					Address:      adress,
-					DevName:      body.DevName,
-					DevType:      pct.Payload.DevType,
-					Status:       false,
-					IsPresent:    true,
-					ConnDevs:     nil,
-					SensorValues: nil,
-					Sensors:      body.DevProps.Sensors,
-					Triggers:     body.DevProps.Triggers,
-					Time:         answerTime,
-				}
-			} else {
-				body := pct.Payload.CmdBody.(Name)
-				database[adress] = &Database{
-					Address:      adress,
-					DevName:      body.DevName,
-					DevType:      pct.Payload.DevType,
-					Status:       false,
-					IsPresent:    true,
-					ConnDevs:     nil,
-					SensorValues: nil,
-					Sensors:      0,
-					Triggers:     nil,
-					Time:         answerTime,
-				}
-			}
+			*tasks = append(*tasks, newPacket(SmartHub, OpenProtocol, IAMHERE, cmdBody))
+
+			h.register(pct, true, answerTime, announced)
 		} else if pct.Payload.Cmd == STATUS {
 			if pct.Payload.Src != OpenProtocol {
 				if len(requestTime[pct.Payload.Src]) >= 2 {
@@ -614,6 +632,11 @@ func handler(database map[int]*Database, requestTime map[int][]int, pcts, tasks
 			}
 			if pct.Payload.DevType == Lamp || pct.Payload.DevType == Socket {
 				cbv := pct.Payload.CmdBody.(Value)
+				h.commands.status(pct.Payload.Src, cbv.Value, answerTime)
+				if database[pct.Payload.Src].StatusKnown && database[pct.Payload.Src].Status != (cbv.Value == 1) {
+					h.scheduler.changed(pct.Payload.Src, answerTime)
+				}
+				database[pct.Payload.Src].StatusKnown = true
 				if cbv.Value == 1 {
 					database[pct.Payload.Src].Status = true
 				} else {
@@ -621,55 +644,45 @@ func handler(database map[int]*Database, requestTime map[int][]int, pcts, tasks
 				}
 			} else if pct.Payload.DevType == Switch {
 				cbv := pct.Payload.CmdBody.(Value)
+				if database[pct.Payload.Src].StatusKnown && database[pct.Payload.Src].Status != (cbv.Value == 1) {
+					h.scheduler.changed(pct.Payload.Src, answerTime)
+				}
+				database[pct.Payload.Src].StatusKnown = true
 				if cbv.Value == 1 {
 					database[pct.Payload.Src].Status = true
-					devNamesTurnOn := database[pct.Payload.Src].ConnDevs
-					setState(tasks, database, devNamesTurnOn, 1, src, serial)
+					devNamesTurnOn := overrides.connDevs(*database[pct.Payload.Src])
+					applyTargets(tasks, database, scenes, devNamesTurnOn, 1, newPacket)
 				} else {
 					database[pct.Payload.Src].Status = false
-					devNamesTurnOff := database[pct.Payload.Src].ConnDevs
-					setState(tasks, database, devNamesTurnOff, 0, src, serial)
+					devNamesTurnOff := overrides.connDevs(*database[pct.Payload.Src])
+					applyTargets(tasks, database, scenes, devNamesTurnOff, 0, newPacket)
 				}
 			} else if pct.Payload.DevType == EnvSensor {
 				values := pct.Payload.CmdBody.(Sensor).Values
-				database[pct.Payload.Src].SensorValues = values
-				valuesAll := [4]int{-1, -1, -1, -1}
 				envSensor := database[pct.Payload.Src]
-				sensorTypeMask := envSensor.Sensors
-				idx := 0
-				for i := 0; i < 4; i++ {
-					if sensorTypeMask&1 == 1 {
-						valuesAll[i] = values[idx]
-						idx++
-					}
-					sensorTypeMask = sensorTypeMask >> 1
+				readings := readingsFromValues(envSensor.Sensors, values)
+				if envSensor.Readings != readings {
+					h.scheduler.changed(envSensor.Address, answerTime)
 				}
-				triggers := envSensor.Triggers
+				envSensor.Readings = readings
+				history.record(envSensor.Address, answerTime, envSensor.Readings)
+				triggers := overrides.triggers(*envSensor)
 
 				for _, trigger := range triggers {
-					value := trigger.Value
-					device := trigger.Name
-					op := trigger.Op
-
-					state := op & 1
-					op = op >> 1
-					greaterThen := op & 1
-					op = op >> 1
-					sensorType := op
-
-					if greaterThen == 1 {
-						if valuesAll[sensorType] > value {
-							setState(tasks, database, []string{device}, state, src, serial)
-						}
-					} else {
-						if valuesAll[sensorType] < value && valuesAll[sensorType] != -1 {
-							setState(tasks, database, []string{device}, state, src, serial)
-						}
+					if !engine.evaluate(envSensor.Address, trigger, envSensor.Readings, answerTime) {
+						continue
 					}
+					metrics.triggersFired.add(1)
+					state, _, _ := parseTriggerOp(trigger.Op)
+					if hasState(database, trigger.Name, state) {
+						continue
+					}
+					applyTargets(tasks, database, scenes, []string{trigger.Name}, state, newPacket)
 				}
 			}
 		}
 	}
+	h.queue.pushAll(*tasks)
 }
 
 func server() {
@@ -683,122 +696,26 @@ func server() {
 		os.Exit(99)
 	}
 
-	database := make(map[int]*Database)
-	requestTime := make(map[int][]int)
-
-	serial := 1
-	var statusCode, hubTime int
-	var requestStr string
-	var responceRawBytes, responceRawBytesTrimed, responseBytes []byte
-
-	tasks := Packets{}
-
-	for {
-		var cbn Name = Name{DevName: HubName}
-		pcts := Packets{
-			Packet{
-				Length: 0,
-				Payload: Payload{
-					Src:     int(hubAddress),
-					Dst:     OpenProtocol,
-					Serial:  serial,
-					DevType: SmartHub,
-					Cmd:     WHOISHERE,
-					CmdBody: cbn,
-				},
-				Crc8: 0,
-			},
-		}
-		serial++
-		pcts[0].Length = byte(len(pcts[0].Payload.toBytes()))
-		pcts[0].Crc8 = computeCRC8Simple(pcts[0].Payload.toBytes())
-		requestStr = base64.RawURLEncoding.EncodeToString(pcts.toBytes())
-		responceRawBytes, statusCode, err = requestServer(url, requestStr)
-		if err != nil {
-			os.Exit(99)
-		}
-
-		if statusCode == http.StatusOK {
-			responceRawBytesTrimed = []byte(removeSpaces(string(responceRawBytes)))
-			responseBytes, err = base64.RawURLEncoding.DecodeString(string(responceRawBytesTrimed))
-			if err != nil {
-				continue
-			}
-			responcePackets := packetsFromBytes(responseBytes)
-			hubTime = findTime(*responcePackets)
-			requestTime[OpenProtocol] = []int{hubTime}
-			handler(database, requestTime, responcePackets, &tasks, int(hubAddress), &serial)
-			for _, dev := range database {
-				dev.IsPresent = true
-			}
-			break
-		} else if statusCode == http.StatusNoContent {
-			os.Exit(0)
-		} else {
-			os.Exit(99)
-		}
+	cfg, err := loadConfig(os.Getenv(ConfigEnv))
+	if err != nil {
+		os.Exit(99)
 	}
-
-	for _, device := range database {
-		if device.DevType == EnvSensor {
-			getStatusRequest := Packet{
-				Length: 0,
-				Payload: Payload{
-					Src:     int(hubAddress),
-					Dst:     device.Address,
-					Serial:  serial,
-					DevType: SmartHub,
-					Cmd:     GETSTATUS,
-					CmdBody: nil,
-				},
-				Crc8: 0,
-			}
-			serial++
-			getStatusRequest.Length = byte(len(getStatusRequest.Payload.toBytes()))
-			getStatusRequest.Crc8 = computeCRC8Simple(getStatusRequest.Payload.toBytes())
-			tasks = append(tasks, getStatusRequest)
-		}
+	h, err := newHub(cfg, url, int(hubAddress))
+	if err != nil {
+		os.Exit(99)
 	}
-
-	for statusCode == http.StatusOK {
-		payloadSwitches(&tasks, database, int(hubAddress), &serial)
-		for _, pct := range tasks {
-			curCmd := pct.Payload.Cmd
-			curDst := pct.Payload.Dst
-			if curCmd == GETSTATUS || curCmd == SETSTATUS {
-				requestTime[curDst] = append(requestTime[curDst], hubTime)
-			}
-		}
-		requestStr = base64.RawURLEncoding.EncodeToString(tasks.toBytes())
-		tasks = Packets{}
-
-		responceRawBytes, statusCode, err = requestServer(url, requestStr)
-
-		if err != nil {
-			continue
-		}
-
-		responcePackets := packetsFromBytes(responseBytes)
-
-		hubTime = findTime(*responcePackets)
-
-		for address, time := range requestTime {
-			if hubTime-time[0] > 300 {
-				if _, ok := database[address]; ok {
-					database[address].IsPresent = false
-				}
-				delete(requestTime, address)
-			}
+	if cfg.APIAddr != "" {
+		if err := serveAPI(cfg.APIAddr, h); err != nil {
+			log.Print(err)
+			os.Exit(99)
 		}
-		handler(database, requestTime, responcePackets, &tasks, int(hubAddress), &serial)
-	}
-
-	if statusCode == http.StatusNoContent {
-		os.Exit(0)
 	}
-	os.Exit(99)
+	os.Exit(h.run())
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == ProxyCommand {
+		os.Exit(proxyMain(os.Args[2:], os.Stdout))
+	}
 	server()
 }
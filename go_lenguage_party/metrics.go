@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var cmdNames = map[cmd]string{
+	WHOISHERE: "WHOISHERE",
+	IAMHERE:   "IAMHERE",
+	GETSTATUS: "GETSTATUS",
+	STATUS:    "STATUS",
+	SETSTATUS: "SETSTATUS",
+	TICK:      "TICK",
+}
+
+var devTypeNames = map[devType]string{
+	SmartHub:  "SmartHub",
+	EnvSensor: "EnvSensor",
+	Switch:    "Switch",
+	Lamp:      "Lamp",
+	Socket:    "Socket",
+	Clock:     "Clock",
+}
+
+func cmdName(c cmd) string {
+	if name, ok := cmdNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", byte(c))
+}
+
+func devTypeName(dt devType) string {
+	if name, ok := devTypeNames[dt]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", byte(dt))
+}
+
+// metricVec holds one counter or gauge per label set, rendered in the
+// Prometheus text format.
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newMetricVec(name, help, kind string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, values: make(map[string]float64)}
+}
+
+func labels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", pairs[i], pairs[i+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (mv *metricVec) add(delta float64, pairs ...string) {
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+	mv.values[labels(pairs...)] += delta
+}
+
+func (mv *metricVec) set(value float64, pairs ...string) {
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+	mv.values[labels(pairs...)] = value
+}
+
+func (mv *metricVec) get(pairs ...string) float64 {
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+	return mv.values[labels(pairs...)]
+}
+
+func (mv *metricVec) writeTo(w io.Writer) {
+	mv.mu.Lock()
+	defer mv.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", mv.name, mv.help, mv.name, mv.kind)
+	keys := make([]string, 0, len(mv.values))
+	for key := range mv.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %g\n", mv.name, key, mv.values[key])
+	}
+}
+
+type histogram struct {
+	name    string
+	help    string
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(name, help string, bounds []float64) *histogram {
+	return &histogram{name: name, help: help, bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+func (hst *histogram) observe(value float64) {
+	hst.mu.Lock()
+	defer hst.mu.Unlock()
+	for i, bound := range hst.bounds {
+		if value <= bound {
+			hst.buckets[i]++
+		}
+	}
+	hst.sum += value
+	hst.count++
+}
+
+func (hst *histogram) writeTo(w io.Writer) {
+	hst.mu.Lock()
+	defer hst.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", hst.name, hst.help, hst.name)
+	for i, bound := range hst.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", hst.name, bound, hst.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", hst.name, hst.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", hst.name, hst.sum, hst.name, hst.count)
+}
+
+type hubMetrics struct {
+	packetsSent     *metricVec
+	packetsReceived *metricVec
+	crcFailures     *metricVec
+	decodeErrors    *metricVec
+	roundTrips      *metricVec
+	lastRoundTrip   *metricVec
+	devices         *metricVec
+	pendingRequests *metricVec
+	triggersFired   *metricVec
+	replaysDropped  *metricVec
+	packetsRejected *metricVec
+	unknownCommands *metricVec
+	serialErrors    *metricVec
+	serial          *metricVec
+	state           *metricVec
+	requestDuration *histogram
+}
+
+func newHubMetrics() *hubMetrics {
+	return &hubMetrics{
+		packetsSent:     newMetricVec("hub_packets_sent_total", "Packets sent to the network.", "counter"),
+		packetsReceived: newMetricVec("hub_packets_received_total", "Packets received from the network.", "counter"),
+		crcFailures:     newMetricVec("hub_crc_failures_total", "Inbound packets dropped on a crc8 mismatch.", "counter"),
+		decodeErrors:    newMetricVec("hub_decode_errors_total", "Inbound batches that could not be decoded.", "counter"),
+		roundTrips:      newMetricVec("hub_round_trips_total", "HTTP round trips to the network by response status.", "counter"),
+		lastRoundTrip:   newMetricVec("hub_last_round_trip_timestamp_seconds", "Unix time of the last successful round trip.", "gauge"),
+		devices:         newMetricVec("hub_devices", "Known devices by presence.", "gauge"),
+		pendingRequests: newMetricVec("hub_pending_requests", "Requests waiting for a STATUS reply.", "gauge"),
+		triggersFired:   newMetricVec("hub_triggers_fired_total", "EnvSensor triggers fired.", "counter"),
+		replaysDropped:  newMetricVec("hub_replays_dropped_total", "Inbound packets dropped for a repeated serial.", "counter"),
+		packetsRejected: newMetricVec("hub_packets_rejected_total", "Inbound packets failing validation by reason.", "counter"),
+		unknownCommands: newMetricVec("hub_unknown_commands_total", "Inbound packets passed through for an unknown devType and cmd.", "counter"),
+		serialErrors:    newMetricVec("hub_serial_errors_total", "Failures to persist the serial reservation.", "counter"),
+		serial:          newMetricVec("hub_serial", "Next serial number the hub will use.", "gauge"),
+		state:           newMetricVec("hub_state", "Current state of the hub, 1 for the active one.", "gauge"),
+		requestDuration: newHistogram(
+			"hub_request_duration_seconds", "HTTP round trip latency.",
+			[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5},
+		),
+	}
+}
+
+var metrics = newHubMetrics()
+
+func (hm *hubMetrics) observeSent(pcts Packets) {
+	for _, pct := range pcts {
+		hm.packetsSent.add(1, "cmd", cmdName(pct.Payload.Cmd), "dev_type", devTypeName(pct.Payload.DevType))
+	}
+}
+
+func (hm *hubMetrics) observeReceived(pcts Packets) {
+	for _, pct := range pcts {
+		hm.packetsReceived.add(1, "cmd", cmdName(pct.Payload.Cmd), "dev_type", devTypeName(pct.Payload.DevType))
+	}
+}
+
+func (hm *hubMetrics) observeRoundTrip(start time.Time, status int, err error) {
+	hm.requestDuration.observe(time.Since(start).Seconds())
+	if err != nil {
+		hm.roundTrips.add(1, "status", "error")
+		return
+	}
+	hm.roundTrips.add(1, "status", fmt.Sprint(status))
+	hm.lastRoundTrip.set(float64(time.Now().Unix()))
+}
+
+func (hm *hubMetrics) observeState(database map[int]*Database, requestTime map[int][]int, serial int) {
+	present, absent := 0, 0
+	for _, dev := range database {
+		if dev.IsPresent {
+			present++
+		} else {
+			absent++
+		}
+	}
+	hm.devices.set(float64(present), "state", "present")
+	hm.devices.set(float64(absent), "state", "absent")
+	pending := 0
+	for address, times := range requestTime {
+		if address == OpenProtocol {
+			continue
+		}
+		pending += len(times)
+	}
+	hm.pendingRequests.set(float64(pending))
+	hm.serial.set(float64(serial))
+}
+
+func (hm *hubMetrics) observeHubState(current hubState) {
+	for state, name := range hubStateNames {
+		value := 0.0
+		if state == current {
+			value = 1
+		}
+		hm.state.set(value, "state", name)
+	}
+}
+
+func (hm *hubMetrics) writeTo(w io.Writer) {
+	for _, mv := range []*metricVec{
+		hm.packetsSent, hm.packetsReceived, hm.crcFailures, hm.decodeErrors,
+		hm.roundTrips, hm.lastRoundTrip, hm.devices, hm.pendingRequests,
+		hm.triggersFired, hm.replaysDropped, hm.packetsRejected, hm.unknownCommands, hm.serial, hm.serialErrors, hm.state,
+	} {
+		mv.writeTo(w)
+	}
+	hm.requestDuration.writeTo(w)
+}
+
+func (hm *hubMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	hm.writeTo(w)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsDecodeFailures(t *testing.T) {
+	data, err := base64.RawURLEncoding.DecodeString("BQECBQIDew")
+	assert.NoError(t, err)
+	crcFailures := metrics.crcFailures.get()
+	decodeErrors := metrics.decodeErrors.get()
+
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-1] ^= 0xFF
+	pcts := packetsFromBytes(append(corrupted, data...))
+	assert.Len(t, *pcts, 1)
+	assert.Equal(t, crcFailures+1, metrics.crcFailures.get())
+
+	pcts = packetsFromBytes(append(data, 0x10, 0x01))
+	assert.Len(t, *pcts, 1)
+	assert.Equal(t, decodeErrors+1, metrics.decodeErrors.get())
+
+	_, skip, err := packetFromBytes([]byte{0x10, 0x01})
+	assert.Error(t, err)
+	assert.Equal(t, 0, skip)
+}
+
+func TestMetricsExposition(t *testing.T) {
+	hm := newHubMetrics()
+	hm.observeSent(Packets{{Payload: Payload{DevType: SmartHub, Cmd: WHOISHERE}}})
+	hm.requestDuration.observe(0.02)
+	hm.unknownCommands.add(1, "cmd", "0x07", "dev_type", "Lamp")
+
+	var out strings.Builder
+	hm.writeTo(&out)
+	assert.Contains(t, out.String(), `hub_packets_sent_total{cmd="WHOISHERE",dev_type="SmartHub"} 1`)
+	assert.Contains(t, out.String(), `hub_request_duration_seconds_bucket{le="0.01"} 0`)
+	assert.Contains(t, out.String(), `hub_request_duration_seconds_bucket{le="0.025"} 1`)
+	assert.Contains(t, out.String(), `hub_request_duration_seconds_count 1`)
+	assert.Contains(t, out.String(), `# TYPE hub_unknown_commands_total counter`)
+	assert.Contains(t, out.String(), `hub_unknown_commands_total{cmd="0x07",dev_type="Lamp"} 1`)
+}
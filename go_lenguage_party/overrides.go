@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+const (
+	FromDevice   string = "device"
+	FromOperator string = "operator"
+)
+
+// DeviceOverride is what the operator changed on top of the triggers and
+// switch targets a device announces about itself.
+type DeviceOverride struct {
+	AddTriggers    []Trigger `json:"add_triggers,omitempty"`
+	RemoveTriggers []Trigger `json:"remove_triggers,omitempty"`
+	AddConnDevs    []string  `json:"add_conn_devs,omitempty"`
+	RemoveConnDevs []string  `json:"remove_conn_devs,omitempty"`
+}
+
+func (ovr DeviceOverride) validate() error {
+	for _, triggers := range [][]Trigger{ovr.AddTriggers, ovr.RemoveTriggers} {
+		for _, trigger := range triggers {
+			if trigger.Op > 0x0F {
+				return errors.New("trigger op out of range")
+			}
+			if trigger.Name == "" {
+				return errors.New("trigger without a device name")
+			}
+		}
+	}
+	for _, names := range [][]string{ovr.AddConnDevs, ovr.RemoveConnDevs} {
+		for _, name := range names {
+			if name == "" {
+				return errors.New("empty switch target")
+			}
+		}
+	}
+	return nil
+}
+
+type TriggerRule struct {
+	Trigger
+	Source string `json:"source"`
+}
+
+type WiringRule struct {
+	DevName string `json:"dev_name"`
+	Source  string `json:"source"`
+}
+
+type Rules struct {
+	Triggers []TriggerRule `json:"triggers"`
+	ConnDevs []WiringRule  `json:"conn_devs"`
+}
+
+// overrideStore keeps operator overrides by device name and writes them to
+// path after every change, so they outlive the hub process.
+type overrideStore struct {
+	mu      sync.RWMutex
+	path    string
+	devices map[string]DeviceOverride
+}
+
+func newOverrideStore(path string, seed map[string]DeviceOverride) (*overrideStore, error) {
+	ovs := &overrideStore{path: path, devices: make(map[string]DeviceOverride)}
+	for name, ovr := range seed {
+		ovs.devices[name] = ovr
+	}
+	if path == "" {
+		return ovs, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ovs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &ovs.devices); err != nil {
+		return nil, err
+	}
+	return ovs, nil
+}
+
+func (ovs *overrideStore) get(name string) (DeviceOverride, bool) {
+	ovs.mu.RLock()
+	defer ovs.mu.RUnlock()
+	ovr, ok := ovs.devices[name]
+	return ovr, ok
+}
+
+func (ovs *overrideStore) all() map[string]DeviceOverride {
+	ovs.mu.RLock()
+	defer ovs.mu.RUnlock()
+	devices := make(map[string]DeviceOverride, len(ovs.devices))
+	for name, ovr := range ovs.devices {
+		devices[name] = ovr
+	}
+	return devices
+}
+
+func (ovs *overrideStore) set(name string, ovr DeviceOverride) error {
+	if err := ovr.validate(); err != nil {
+		return err
+	}
+	ovs.mu.Lock()
+	defer ovs.mu.Unlock()
+	ovs.devices[name] = ovr
+	return ovs.save()
+}
+
+func (ovs *overrideStore) remove(name string) error {
+	ovs.mu.Lock()
+	defer ovs.mu.Unlock()
+	delete(ovs.devices, name)
+	return ovs.save()
+}
+
+func (ovs *overrideStore) save() error {
+	if ovs.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(ovs.devices, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ovs.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ovs.path)
+}
+
+// rules merges what dev announced with the operator override for it.
+func (ovs *overrideStore) rules(dev Database) Rules {
+	ovr, _ := ovs.get(dev.DevName)
+	rules := Rules{Triggers: []TriggerRule{}, ConnDevs: []WiringRule{}}
+
+	removedTriggers := make(map[Trigger]bool)
+	for _, trigger := range ovr.RemoveTriggers {
+		removedTriggers[trigger] = true
+	}
+	for _, trigger := range dev.Triggers {
+		if !removedTriggers[trigger] {
+			rules.Triggers = append(rules.Triggers, TriggerRule{Trigger: trigger, Source: FromDevice})
+		}
+	}
+	for _, trigger := range ovr.AddTriggers {
+		rules.Triggers = append(rules.Triggers, TriggerRule{Trigger: trigger, Source: FromOperator})
+	}
+
+	removedConnDevs := make(map[string]bool)
+	for _, name := range ovr.RemoveConnDevs {
+		removedConnDevs[name] = true
+	}
+	for _, name := range dev.ConnDevs {
+		if !removedConnDevs[name] {
+			rules.ConnDevs = append(rules.ConnDevs, WiringRule{DevName: name, Source: FromDevice})
+		}
+	}
+	for _, name := range ovr.AddConnDevs {
+		rules.ConnDevs = append(rules.ConnDevs, WiringRule{DevName: name, Source: FromOperator})
+	}
+	return rules
+}
+
+func (ovs *overrideStore) triggers(dev Database) []Trigger {
+	rules := ovs.rules(dev)
+	triggers := make([]Trigger, len(rules.Triggers))
+	for i, rule := range rules.Triggers {
+		triggers[i] = rule.Trigger
+	}
+	return triggers
+}
+
+func (ovs *overrideStore) connDevs(dev Database) []string {
+	rules := ovs.rules(dev)
+	names := make([]string, len(rules.ConnDevs))
+	for i, rule := range rules.ConnDevs {
+		names[i] = rule.DevName
+	}
+	return names
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverrideRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overrides.json")
+	overrides, err := newOverrideStore(path, nil)
+	assert.NoError(t, err)
+
+	sensor := Database{
+		DevName: "SENSOR01",
+		DevType: EnvSensor,
+		Triggers: []Trigger{
+			{Op: 12, Value: 100, Name: "OTHER1"},
+			{Op: 15, Value: 1200, Name: "OTHER2"},
+		},
+	}
+	assert.NoError(t, overrides.set("SENSOR01", DeviceOverride{
+		AddTriggers:    []Trigger{{Op: 3, Value: 30, Name: "LAMP01"}},
+		RemoveTriggers: []Trigger{{Op: 12, Value: 100, Name: "OTHER1"}},
+	}))
+	assert.Equal(t, []TriggerRule{
+		{Trigger: Trigger{Op: 15, Value: 1200, Name: "OTHER2"}, Source: FromDevice},
+		{Trigger: Trigger{Op: 3, Value: 30, Name: "LAMP01"}, Source: FromOperator},
+	}, overrides.rules(sensor).Triggers)
+
+	swt := Database{DevName: "SWITCH01", DevType: Switch, ConnDevs: []string{"DEV01", "DEV02"}}
+	assert.NoError(t, overrides.set("SWITCH01", DeviceOverride{
+		AddConnDevs:    []string{"LAMP01"},
+		RemoveConnDevs: []string{"DEV02"},
+	}))
+	assert.Equal(t, []string{"DEV01", "LAMP01"}, overrides.connDevs(swt))
+
+	assert.Error(t, overrides.set("SENSOR01", DeviceOverride{AddTriggers: []Trigger{{Op: 0x10, Name: "LAMP01"}}}))
+
+	reloaded, err := newOverrideStore(path, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, overrides.all(), reloaded.all())
+}
+
+func TestOverridesPersistNextToConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hub.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{}`), 0o644))
+	cfg, err := loadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, OverridesFile), cfg.OverridesPath)
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"overrides_path": ""}`), 0o644))
+	cfg, err = loadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "", cfg.OverridesPath)
+
+	cfg, err = loadConfig("")
+	assert.NoError(t, err)
+	assert.Equal(t, "", cfg.OverridesPath)
+}
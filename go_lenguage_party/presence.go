@@ -0,0 +1,66 @@
+package main
+
+type Downtime struct {
+	From int `json:"from"`
+	To   int `json:"to,omitempty"`
+}
+
+type recoveryState struct {
+	nextProbe int
+	backoff   int
+}
+
+type recoveryStates map[int]*recoveryState
+
+// rebase moves the probes due by shift when the hub clock jumps.
+func (rs recoveryStates) rebase(shift int) {
+	for _, rec := range rs {
+		rec.nextProbe += shift
+	}
+}
+
+// markAbsent starts a downtime interval for dev and schedules the first
+// recovery probe.
+func (h *hub) markAbsent(dev *Database, now int) {
+	dev.IsPresent = false
+	dev.Downtimes = append(dev.Downtimes, Downtime{From: now})
+	if limit := h.cfg.DowntimeHistory; limit > 0 && len(dev.Downtimes) > limit {
+		dev.Downtimes = dev.Downtimes[len(dev.Downtimes)-limit:]
+	}
+	if h.cfg.RecoveryEnabled {
+		h.recovery[dev.Address] = &recoveryState{
+			nextProbe: now + h.cfg.RecoveryBackoff,
+			backoff:   h.cfg.RecoveryBackoff,
+		}
+	}
+}
+
+// markPresent closes the open downtime interval of dev and stops probing it.
+func (h *hub) markPresent(dev *Database, now int) {
+	dev.IsPresent = true
+	if last := len(dev.Downtimes) - 1; last >= 0 && dev.Downtimes[last].To == 0 {
+		dev.Downtimes[last].To = now
+	}
+	delete(h.recovery, dev.Address)
+}
+
+// probeAbsent sends GETSTATUS to the absent devices whose probe is due and
+// doubles their backoff up to RecoveryMaxBackoff.
+func (h *hub) probeAbsent() {
+	for address, rec := range h.recovery {
+		dev, ok := h.reg.devices[address]
+		if !ok || dev.IsPresent {
+			delete(h.recovery, address)
+			continue
+		}
+		if h.hubTime < rec.nextProbe {
+			continue
+		}
+		h.queue.push(h.newPacket(address, GETSTATUS, nil), PriorityPoll)
+		rec.backoff *= 2
+		if rec.backoff > h.cfg.RecoveryMaxBackoff {
+			rec.backoff = h.cfg.RecoveryMaxBackoff
+		}
+		rec.nextProbe = h.hubTime + rec.backoff
+	}
+}
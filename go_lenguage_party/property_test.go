@@ -0,0 +1,151 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type bodyKind byte
+
+const (
+	noBody bodyKind = iota
+	nameBody
+	sensorsBody
+	switchBody
+	sensorBody
+	valueBody
+	timestampBody
+)
+
+// validPairs lists every (devType, cmd) the codec knows and the body it
+// carries.
+var validPairs = []struct {
+	dt   devType
+	c    cmd
+	body bodyKind
+}{
+	{SmartHub, WHOISHERE, nameBody},
+	{SmartHub, IAMHERE, nameBody},
+	{SmartHub, GETSTATUS, noBody},
+	{EnvSensor, WHOISHERE, sensorsBody},
+	{EnvSensor, IAMHERE, sensorsBody},
+	{EnvSensor, GETSTATUS, noBody},
+	{EnvSensor, STATUS, sensorBody},
+	{Switch, WHOISHERE, switchBody},
+	{Switch, IAMHERE, switchBody},
+	{Switch, GETSTATUS, noBody},
+	{Switch, STATUS, valueBody},
+	{Lamp, WHOISHERE, nameBody},
+	{Lamp, IAMHERE, nameBody},
+	{Lamp, GETSTATUS, noBody},
+	{Lamp, STATUS, valueBody},
+	{Lamp, SETSTATUS, valueBody},
+	{Socket, WHOISHERE, nameBody},
+	{Socket, IAMHERE, nameBody},
+	{Socket, GETSTATUS, noBody},
+	{Socket, STATUS, valueBody},
+	{Socket, SETSTATUS, valueBody},
+	{Clock, WHOISHERE, nameBody},
+	{Clock, IAMHERE, nameBody},
+	{Clock, TICK, timestampBody},
+}
+
+func randomName(rnd *rand.Rand) string {
+	name := make([]byte, rnd.Intn(16))
+	rnd.Read(name)
+	return string(name)
+}
+
+// randomULEB spreads values over every encoded length up to 5 bytes.
+func randomULEB(rnd *rand.Rand) int {
+	return rnd.Intn(1 << (7 * (rnd.Intn(5) + 1)))
+}
+
+func randomBody(rnd *rand.Rand, kind bodyKind) CmdBodyBytes {
+	switch kind {
+	case nameBody:
+		return Name{DevName: randomName(rnd)}
+	case sensorsBody:
+		triggers := make([]Trigger, rnd.Intn(5))
+		for i := range triggers {
+			triggers[i] = Trigger{Op: byte(rnd.Intn(16)), Value: randomULEB(rnd), Name: randomName(rnd)}
+		}
+		return Sensors{
+			DevName:  randomName(rnd),
+			DevProps: EnvSensorProps{Sensors: byte(rnd.Intn(16)), Triggers: triggers},
+		}
+	case switchBody:
+		names := make([]string, rnd.Intn(6))
+		for i := range names {
+			names[i] = randomName(rnd)
+		}
+		return SwitchDevice{DevName: randomName(rnd), DevProps: DevProps{DevNames: names}}
+	case sensorBody:
+		values := make([]int, rnd.Intn(5))
+		for i := range values {
+			values[i] = randomULEB(rnd)
+		}
+		return Sensor{Values: values}
+	case valueBody:
+		return Value{Value: byte(rnd.Intn(2))}
+	case timestampBody:
+		return Timestamp{Timestamp: rnd.Intn(1 << 42)}
+	}
+	return nil
+}
+
+type randomPayload struct {
+	Payload
+}
+
+func (randomPayload) Generate(rnd *rand.Rand, size int) reflect.Value {
+	pair := validPairs[rnd.Intn(len(validPairs))]
+	return reflect.ValueOf(randomPayload{Payload{
+		Src:     rnd.Intn(OpenProtocol + 1),
+		Dst:     rnd.Intn(OpenProtocol + 1),
+		Serial:  randomULEB(rnd),
+		DevType: pair.dt,
+		Cmd:     pair.c,
+		CmdBody: randomBody(rnd, pair.body),
+	}})
+}
+
+func TestPayloadRoundTripProperty(t *testing.T) {
+	roundTrip := func(p randomPayload) bool {
+		return reflect.DeepEqual(p.Payload, *payloadFromBytes(p.toBytes()))
+	}
+	assert.NoError(t, quick.Check(roundTrip, &quick.Config{MaxCount: 2000}))
+}
+
+func TestPacketCRCProperty(t *testing.T) {
+	consistent := func(p randomPayload) bool {
+		pct := devicePacket(p.Src, p.Dst, p.Serial, p.DevType, p.Cmd, p.CmdBody)
+		data := pct.toBytes()
+		// the remainder of a frame followed by its own crc8 is zero
+		if computeCRC8Simple(data[1:]) != 0 {
+			return false
+		}
+		decoded, skip, err := packetFromBytes(data)
+		return err == nil && decoded != nil && skip == len(data) && reflect.DeepEqual(pct, *decoded)
+	}
+	assert.NoError(t, quick.Check(consistent, &quick.Config{MaxCount: 2000}))
+}
+
+func TestPacketsRoundTripProperty(t *testing.T) {
+	roundTrip := func(ps []randomPayload) bool {
+		pcts := Packets{}
+		for _, p := range ps {
+			pcts = append(pcts, devicePacket(p.Src, p.Dst, p.Serial, p.DevType, p.Cmd, p.CmdBody))
+		}
+		decoded := *packetsFromBytes(pcts.toBytes())
+		if len(pcts) == 0 {
+			return len(decoded) == 0
+		}
+		return reflect.DeepEqual(pcts, decoded)
+	}
+	assert.NoError(t, quick.Check(roundTrip, &quick.Config{MaxCount: 500}))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// supportedProtocolVersion is the newest protocol revision the codec
+// decodes, anything a newer network adds reaches the hub as RawBody.
+const supportedProtocolVersion = 1
+
+// knownPairs are the (devType, cmd) combinations of protocol version 1.
+var knownPairs = map[devType][]cmd{
+	SmartHub:  {WHOISHERE, IAMHERE, GETSTATUS},
+	EnvSensor: {WHOISHERE, IAMHERE, GETSTATUS, STATUS},
+	Switch:    {WHOISHERE, IAMHERE, GETSTATUS, STATUS},
+	Lamp:      {WHOISHERE, IAMHERE, GETSTATUS, STATUS, SETSTATUS},
+	Socket:    {WHOISHERE, IAMHERE, GETSTATUS, STATUS, SETSTATUS},
+	Clock:     {WHOISHERE, IAMHERE, TICK},
+}
+
+func knownPair(dt devType, c cmd) bool {
+	for _, known := range knownPairs[dt] {
+		if known == c {
+			return true
+		}
+	}
+	return false
+}
+
+func validateProtocolVersion(version int) error {
+	if version < 1 {
+		return fmt.Errorf("protocol version %d, versions start at 1", version)
+	}
+	if version > supportedProtocolVersion {
+		log.Printf("protocol version %d is newer than %d, unknown commands are passed through",
+			version, supportedProtocolVersion)
+	}
+	return nil
+}
+
+// passthrough hands a packet the hub cannot interpret to the event log
+// with its body untouched instead of dropping it.
+func (h *hub) passthrough(pct Packet) {
+	pld := pct.Payload
+	var body []byte
+	if pld.CmdBody != nil {
+		body = pld.CmdBody.toBytes()
+	}
+	metrics.unknownCommands.add(1, "cmd", cmdName(pld.Cmd), "dev_type", devTypeName(pld.DevType))
+	log.Printf("unknown %s/%s from %x, %d body bytes (protocol version %d)",
+		devTypeName(pld.DevType), cmdName(pld.Cmd), pld.Src, len(body), h.cfg.ProtocolVersion)
+	h.events.emit(DeviceEvent{
+		Kind:    EventUnknownCommand,
+		Address: pld.Src,
+		DevType: pld.DevType,
+		Cmd:     pld.Cmd,
+		Body:    body,
+		Time:    h.hubTime,
+	})
+}
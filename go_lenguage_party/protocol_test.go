@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRawBodyRoundTrip(t *testing.T) {
+	pcts := Packets{
+		devicePacket(4, 1, 7, Lamp, cmd(0x07), RawBody{Bytes: []byte{0x01, 0xFF, 0x80}}),
+		devicePacket(9, OpenProtocol, 1, devType(0x07), WHOISHERE, RawBody{Bytes: []byte("NEWDEV")}),
+		devicePacket(6, OpenProtocol, 2, Clock, STATUS, nil),
+	}
+	data := pcts.toBytes()
+	decoded := packetsFromBytes(data)
+	assert.Equal(t, pcts, *decoded)
+	assert.Equal(t, data, decoded.toBytes())
+}
+
+func TestKnownPairsMatchCodec(t *testing.T) {
+	for _, pair := range validPairs {
+		assert.True(t, knownPair(pair.dt, pair.c), "%s/%s", devTypeName(pair.dt), cmdName(pair.c))
+	}
+	assert.False(t, knownPair(Clock, STATUS))
+	assert.False(t, knownPair(Lamp, cmd(0x07)))
+}
+
+func TestHubPassesThroughUnknownCommands(t *testing.T) {
+	h, err := newHub(defaultConfig(), "", 1)
+	assert.NoError(t, err)
+	before := metrics.unknownCommands.get("cmd", "0x07", "dev_type", "Lamp")
+
+	h.handler(&Packets{devicePacket(4, 1, 3, Lamp, cmd(0x07), RawBody{Bytes: []byte{0x2A}})})
+
+	assert.Equal(t, before+1, metrics.unknownCommands.get("cmd", "0x07", "dev_type", "Lamp"))
+	events := h.events.since(0)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, EventUnknownCommand, events[0].Kind)
+		assert.Equal(t, 4, events[0].Address)
+		assert.Equal(t, cmd(0x07), events[0].Cmd)
+		assert.Equal(t, []byte{0x2A}, events[0].Body)
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	assert.Equal(t, supportedProtocolVersion, defaultConfig().ProtocolVersion)
+	cfg := defaultConfig()
+	cfg.ProtocolVersion = 0
+	_, err := newHub(cfg, "", 1)
+	assert.Error(t, err)
+	cfg.ProtocolVersion = supportedProtocolVersion + 1
+	_, err = newHub(cfg, "", 1)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyCommand switches the binary into smarthome-proxy mode:
+//
+//	go_lenguage_party proxy [-addr 2,3f] [-cmd STATUS,SETSTATUS] [-faults faults.json] [-crc8 1d,0,0] <listen> <upstream>
+//
+// It is a mode of the hub binary rather than a cmd/smarthome-proxy of its
+// own because the codec lives in package main. The proxy shares nothing with
+// the hub beyond the codec and works in front of any hub.
+const ProxyCommand string = "proxy"
+
+const (
+	DirectionRequest  string = "request"
+	DirectionResponse string = "response"
+)
+
+// proxyFilter keeps the packets to or from one of addrs and with one of
+// cmds, an empty set does not filter.
+type proxyFilter struct {
+	addrs map[int]bool
+	cmds  map[cmd]bool
+}
+
+func parseProxyFilter(addrs, cmds string) (proxyFilter, error) {
+	filter := proxyFilter{addrs: make(map[int]bool), cmds: make(map[cmd]bool)}
+	for _, field := range strings.Split(addrs, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		addr, err := strconv.ParseInt(field, 16, 64)
+		if err != nil {
+			return filter, fmt.Errorf("bad address %q", field)
+		}
+		filter.addrs[int(addr)] = true
+	}
+	for _, field := range strings.Split(cmds, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		c, ok := cmdByName(field)
+		if !ok {
+			return filter, fmt.Errorf("bad cmd %q", field)
+		}
+		filter.cmds[c] = true
+	}
+	return filter, nil
+}
+
+// cmdByName accepts the names of cmdNames in any case or a hex byte.
+func cmdByName(name string) (cmd, bool) {
+	for c, known := range cmdNames {
+		if strings.EqualFold(known, name) {
+			return c, true
+		}
+	}
+	value, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(name), "0x"), 16, 8)
+	if err != nil {
+		return 0, false
+	}
+	return cmd(value), true
+}
+
+func (f proxyFilter) match(pct Packet) bool {
+	pld := pct.Payload
+	if len(f.addrs) > 0 && !f.addrs[pld.Src] && !f.addrs[pld.Dst] {
+		return false
+	}
+	return len(f.cmds) == 0 || f.cmds[pld.Cmd]
+}
+
+func (f proxyFilter) active() bool {
+	return len(f.addrs) > 0 || len(f.cmds) > 0
+}
+
+// ProxyRecord is one direction of one round trip as the proxy logs it.
+type ProxyRecord struct {
+	Round     int      `json:"round"`
+	Direction string   `json:"direction"`
+	Time      string   `json:"time"`
+	Status    int      `json:"status,omitempty"`
+	ElapsedMs float64  `json:"elapsed_ms,omitempty"`
+	Packets   []Packet `json:"packets"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// proxy forwards the hub's POSTs to upstream byte for byte and writes both
+// directions to out as JSON lines. With faults set the replies are damaged
+// on the way back and logged as the hub gets them.
+type proxy struct {
+	upstream string
+	client   *http.Client
+	filter   proxyFilter
+	codec    codec
+	faults   *faultInjector
+
+	mu    sync.Mutex
+	out   *json.Encoder
+	round int
+}
+
+func newProxy(upstream string, filter proxyFilter, out io.Writer) *proxy {
+	return &proxy{
+		upstream: upstream,
+		client:   &http.Client{},
+		filter:   filter,
+		codec:    defaultCodec,
+		out:      json.NewEncoder(out),
+	}
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	request, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.mu.Lock()
+	p.round++
+	round := p.round
+	p.mu.Unlock()
+	p.record(ProxyRecord{Round: round, Direction: DirectionRequest}, request)
+
+	req, err := http.NewRequest(r.Method, p.upstream, bytes.NewReader(request))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	req.Header = r.Header.Clone()
+	start := time.Now()
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.record(ProxyRecord{Round: round, Direction: DirectionResponse, Error: err.Error()}, nil)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	response, err := io.ReadAll(resp.Body)
+	elapsed := float64(time.Since(start).Microseconds()) / 1000
+	rec := ProxyRecord{Round: round, Direction: DirectionResponse, Status: resp.StatusCode, ElapsedMs: elapsed}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if p.faults != nil && err == nil && resp.StatusCode == http.StatusOK {
+		response = p.injectFaults(response)
+		resp.Header.Del("Content-Length")
+	}
+	p.record(rec, response)
+
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(response)
+}
+
+func (p *proxy) injectFaults(response []byte) []byte {
+	data, err := base64.RawURLEncoding.DecodeString(removeSpaces(string(response)))
+	if err != nil {
+		return response
+	}
+	p.mu.Lock()
+	data = p.faults.apply(data)
+	p.mu.Unlock()
+	return []byte(base64.RawURLEncoding.EncodeToString(data))
+}
+
+// record decodes body into rec and writes it unless the filter leaves
+// nothing of a non-empty batch.
+func (p *proxy) record(rec ProxyRecord, body []byte) {
+	rec.Time = time.Now().Format(time.RFC3339Nano)
+	rec.Packets = make([]Packet, 0)
+	data, err := base64.RawURLEncoding.DecodeString(removeSpaces(string(body)))
+	if err != nil && rec.Error == "" {
+		rec.Error = err.Error()
+	}
+	pcts := *p.codec.packetsFromBytes(data)
+	for _, pct := range pcts {
+		if p.filter.match(pct) {
+			rec.Packets = append(rec.Packets, pct)
+		}
+	}
+	if p.filter.active() && len(pcts) > 0 && len(rec.Packets) == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.out.Encode(rec); err != nil {
+		log.Print(err)
+	}
+}
+
+func proxyMain(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet(ProxyCommand, flag.ContinueOnError)
+	addrs := flags.String("addr", "", "comma separated hex addresses to log")
+	cmds := flags.String("cmd", "", "comma separated commands to log")
+	faults := flags.String("faults", "", "fault injection config for the replies")
+	crc := flags.String("crc8", "", "crc8 variant as hex poly,init,xorout")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return 99
+	}
+	filter, err := parseProxyFilter(*addrs, *cmds)
+	if err != nil {
+		log.Print(err)
+		return 99
+	}
+	p := newProxy(getConnectiongString(flags.Arg(1)), filter, out)
+	if *crc != "" {
+		params, err := parseCRC8Params(*crc)
+		if err != nil {
+			log.Print(err)
+			return 99
+		}
+		p.codec = newCodec(params)
+	}
+	if *faults != "" {
+		fc, err := loadFaultConfig(*faults)
+		if err != nil {
+			log.Print(err)
+			return 99
+		}
+		if p.faults, err = newFaultInjector(fc, p.codec); err != nil {
+			log.Print(err)
+			return 99
+		}
+	}
+	log.Printf("proxying %s to %s", flags.Arg(0), p.upstream)
+	if err := http.ListenAndServe(flags.Arg(0), p); err != nil {
+		log.Print(err)
+	}
+	return 99
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// loggedRecord reads back a ProxyRecord, bodies stay undecoded since
+// CmdBodyBytes has no unmarshaller.
+type loggedRecord struct {
+	Round     int    `json:"round"`
+	Direction string `json:"direction"`
+	Status    int    `json:"status"`
+	Packets   []struct {
+		Payload struct {
+			Cmd     cmd             `json:"cmd"`
+			CmdBody json.RawMessage `json:"cmd_body"`
+		} `json:"payload"`
+	} `json:"packets"`
+}
+
+func proxyRecords(t *testing.T, out *bytes.Buffer) []loggedRecord {
+	var records []loggedRecord
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		var rec loggedRecord
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &rec))
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestProxyForwardsUnchanged(t *testing.T) {
+	answer := Packets{
+		devicePacket(4, 1, 1, Lamp, STATUS, Value{Value: 1}),
+		devicePacket(6, OpenProtocol, 2, Clock, TICK, Timestamp{Timestamp: 1000}),
+	}
+	upstream := fakeNetwork(answer)
+	defer upstream.Close()
+	out := &bytes.Buffer{}
+	proxied := httptest.NewServer(newProxy(upstream.URL, proxyFilter{}, out))
+	defer proxied.Close()
+
+	request := base64.RawURLEncoding.EncodeToString(Packets{
+		devicePacket(1, 4, 5, SmartHub, GETSTATUS, nil),
+	}.toBytes())
+	body, status, err := requestServer(proxied.URL, request)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(answer.toBytes()), string(body))
+
+	_, status, err = requestServer(proxied.URL, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 204, status)
+
+	records := proxyRecords(t, out)
+	if assert.Len(t, records, 4) {
+		assert.Equal(t, DirectionRequest, records[0].Direction)
+		assert.Len(t, records[0].Packets, 1)
+		assert.Equal(t, GETSTATUS, records[0].Packets[0].Payload.Cmd)
+		assert.Equal(t, DirectionResponse, records[1].Direction)
+		assert.Equal(t, 200, records[1].Status)
+		if assert.Len(t, records[1].Packets, 2) {
+			assert.JSONEq(t, `{"timestamp":1000}`, string(records[1].Packets[1].Payload.CmdBody))
+		}
+		assert.Equal(t, 2, records[3].Round)
+		assert.Equal(t, 204, records[3].Status)
+	}
+}
+
+func TestProxyFilter(t *testing.T) {
+	filter, err := parseProxyFilter("4", "status,0x06")
+	assert.NoError(t, err)
+	assert.True(t, filter.match(devicePacket(4, 1, 1, Lamp, STATUS, Value{Value: 1})))
+	assert.True(t, filter.match(devicePacket(1, 4, 1, Clock, TICK, Timestamp{Timestamp: 1})))
+	assert.False(t, filter.match(devicePacket(5, 1, 1, Socket, STATUS, Value{Value: 1})))
+	assert.False(t, filter.match(devicePacket(4, 1, 1, Lamp, IAMHERE, Name{DevName: "LAMP01"})))
+
+	_, err = parseProxyFilter("zz", "")
+	assert.Error(t, err)
+	_, err = parseProxyFilter("", "NOPE")
+	assert.Error(t, err)
+
+	upstream := fakeNetwork(Packets{devicePacket(5, 1, 1, Socket, STATUS, Value{Value: 1})})
+	defer upstream.Close()
+	out := &bytes.Buffer{}
+	proxied := httptest.NewServer(newProxy(upstream.URL, filter, out))
+	defer proxied.Close()
+	request := base64.RawURLEncoding.EncodeToString(Packets{
+		devicePacket(1, 4, 5, SmartHub, GETSTATUS, nil),
+	}.toBytes())
+	_, _, err = requestServer(proxied.URL, request)
+	assert.NoError(t, err)
+	assert.Empty(t, proxyRecords(t, out))
+}
+
+func TestProxyDecodesConfiguredCRC8(t *testing.T) {
+	variant := newCodec(CRC8Params{Poly: 0x07, XorOut: 0x55})
+	pct := Packet{Payload: Payload{Src: 4, Dst: 1, Serial: 1, DevType: Lamp, Cmd: STATUS, CmdBody: Value{Value: 1}}}
+	variant.seal(&pct, nil)
+	body := []byte(base64.RawURLEncoding.EncodeToString(Packets{pct}.toBytes()))
+
+	out := &bytes.Buffer{}
+	p := newProxy("", proxyFilter{}, out)
+	p.record(ProxyRecord{Direction: DirectionResponse}, body)
+	p.codec = variant
+	p.record(ProxyRecord{Direction: DirectionResponse}, body)
+
+	records := proxyRecords(t, out)
+	if assert.Len(t, records, 2) {
+		assert.Empty(t, records[0].Packets)
+		assert.Len(t, records[1].Packets, 1)
+	}
+	assert.Equal(t, 99, proxyMain([]string{"-crc8", "0", ":0", "localhost:1"}, out))
+}
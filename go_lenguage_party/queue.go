@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/base64"
+	"sort"
+)
+
+type priority byte
+
+const (
+	PriorityPoll     priority = 0x01
+	PriorityRule     priority = 0x02
+	PriorityUser     priority = 0x03
+	PriorityProtocol priority = 0x04
+)
+
+type outbound struct {
+	pct  Packet
+	prio priority
+	seq  int
+}
+
+// outboundQueue collects the packets for the next round. A newer SETSTATUS
+// to a device replaces the queued one and a GETSTATUS already queued for a
+// device isn't queued twice. pop sends the highest priorities first, up to
+// maxBody bytes of request body, and keeps the rest for the next round.
+type outboundQueue struct {
+	items   []outbound
+	seq     int
+	maxBody int
+}
+
+func newOutboundQueue(maxBody int) *outboundQueue {
+	return &outboundQueue{maxBody: maxBody}
+}
+
+// priorityFor is the priority of packets the hub produces on its own.
+func priorityFor(c cmd) priority {
+	switch c {
+	case WHOISHERE, IAMHERE:
+		return PriorityProtocol
+	case GETSTATUS:
+		return PriorityPoll
+	}
+	return PriorityRule
+}
+
+func (oq *outboundQueue) push(pct Packet, prio priority) {
+	dst, c := pct.Payload.Dst, pct.Payload.Cmd
+	if c == SETSTATUS || c == GETSTATUS {
+		for i, item := range oq.items {
+			if item.pct.Payload.Dst != dst || item.pct.Payload.Cmd != c {
+				continue
+			}
+			if c == GETSTATUS {
+				if prio > item.prio {
+					oq.items[i].prio = prio
+				}
+				return
+			}
+			if item.prio > prio {
+				prio = item.prio
+			}
+			oq.items = append(oq.items[:i], oq.items[i+1:]...)
+			break
+		}
+	}
+	oq.seq++
+	oq.items = append(oq.items, outbound{pct: pct, prio: prio, seq: oq.seq})
+}
+
+func (oq *outboundQueue) pushAll(pcts Packets) {
+	for _, pct := range pcts {
+		oq.push(pct, priorityFor(pct.Payload.Cmd))
+	}
+}
+
+func (oq *outboundQueue) len() int {
+	return len(oq.items)
+}
+
+func (oq *outboundQueue) pop() Packets {
+	sort.SliceStable(oq.items, func(i, j int) bool {
+		if oq.items[i].prio != oq.items[j].prio {
+			return oq.items[i].prio > oq.items[j].prio
+		}
+		return oq.items[i].seq < oq.items[j].seq
+	})
+	batch := Packets{}
+	size := 0
+	taken := 0
+	var scratch []byte
+	for _, item := range oq.items {
+		scratch = item.pct.appendBytes(scratch[:0])
+		pctSize := len(scratch)
+		if oq.maxBody > 0 && taken > 0 && base64.RawURLEncoding.EncodedLen(size+pctSize) > oq.maxBody {
+			break
+		}
+		batch = append(batch, item.pct)
+		size += pctSize
+		taken++
+	}
+	oq.items = append([]outbound{}, oq.items[taken:]...)
+	return batch
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutboundQueue(t *testing.T) {
+	oq := newOutboundQueue(0)
+	oq.push(devicePacket(1, 4, 1, SmartHub, GETSTATUS, nil), PriorityPoll)
+	oq.push(devicePacket(1, 4, 2, SmartHub, SETSTATUS, Value{Value: 1}), PriorityRule)
+	oq.push(devicePacket(1, 5, 3, SmartHub, SETSTATUS, Value{Value: 1}), PriorityUser)
+	oq.push(devicePacket(1, 4, 4, SmartHub, SETSTATUS, Value{Value: 0}), PriorityRule)
+	oq.push(devicePacket(1, 4, 5, SmartHub, GETSTATUS, nil), PriorityPoll)
+	oq.push(devicePacket(1, OpenProtocol, 6, SmartHub, IAMHERE, Name{DevName: HubName}), PriorityProtocol)
+
+	batch := oq.pop()
+	serials := make([]int, len(batch))
+	for i, pct := range batch {
+		serials[i] = pct.Payload.Serial
+	}
+	assert.Equal(t, []int{6, 3, 4, 1}, serials)
+	assert.Equal(t, 0, oq.len())
+}
+
+func TestOutboundQueueBodyLimit(t *testing.T) {
+	oq := newOutboundQueue(20)
+	for dst := 2; dst < 6; dst++ {
+		oq.push(devicePacket(1, dst, dst, SmartHub, GETSTATUS, nil), PriorityPoll)
+	}
+	// every GETSTATUS is 7 bytes, two of them make 19 base64 characters
+	assert.Len(t, oq.pop(), 2)
+	assert.Equal(t, 2, oq.len())
+	assert.Len(t, oq.pop(), 2)
+	assert.Equal(t, 0, oq.len())
+}
@@ -0,0 +1,68 @@
+package main
+
+type sensorType byte
+
+const (
+	Temperature  sensorType = 0x00
+	Humidity     sensorType = 0x01
+	Illuminance  sensorType = 0x02
+	AirPollution sensorType = 0x03
+)
+
+const sensorTypes = 4
+
+type Reading struct {
+	Value   int  `json:"value"`
+	Present bool `json:"present"`
+}
+
+type Readings struct {
+	Temperature  Reading `json:"temperature"`
+	Humidity     Reading `json:"humidity"`
+	Illuminance  Reading `json:"illuminance"`
+	AirPollution Reading `json:"air_pollution"`
+}
+
+// readingsFromValues spreads the positional STATUS values over the sensors
+// enabled in mask, lowest bit first.
+func readingsFromValues(mask byte, values []int) Readings {
+	var rds Readings
+	idx := 0
+	for i := 0; i < sensorTypes; i++ {
+		if mask&1 == 1 && idx < len(values) {
+			*rds.at(sensorType(i)) = Reading{Value: values[idx], Present: true}
+			idx++
+		}
+		mask >>= 1
+	}
+	return rds
+}
+
+func (rds *Readings) at(st sensorType) *Reading {
+	switch st {
+	case Temperature:
+		return &rds.Temperature
+	case Humidity:
+		return &rds.Humidity
+	case Illuminance:
+		return &rds.Illuminance
+	case AirPollution:
+		return &rds.AirPollution
+	}
+	return nil
+}
+
+func (rds Readings) get(st sensorType) (int, bool) {
+	rd := rds.at(st)
+	if rd == nil || !rd.Present {
+		return 0, false
+	}
+	return rd.Value, true
+}
+
+var sensorNames = map[string]sensorType{
+	"temperature":   Temperature,
+	"humidity":      Humidity,
+	"illuminance":   Illuminance,
+	"air_pollution": AirPollution,
+}
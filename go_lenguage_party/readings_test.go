@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadingsFromValues(t *testing.T) {
+	rds := readingsFromValues(0b1010, []int{55, 720})
+	assert.Equal(t, Readings{
+		Humidity:     Reading{Value: 55, Present: true},
+		AirPollution: Reading{Value: 720, Present: true},
+	}, rds)
+
+	_, ok := rds.get(Temperature)
+	assert.False(t, ok)
+	value, ok := rds.get(AirPollution)
+	assert.True(t, ok)
+	assert.Equal(t, 720, value)
+
+	short := readingsFromValues(0b1111, []int{20})
+	assert.Equal(t, Readings{Temperature: Reading{Value: 20, Present: true}}, short)
+}
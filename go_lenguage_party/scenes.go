@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const dayMillis = 24 * 60 * 60 * 1000
+
+// Schedule activates Scene every day at At, a "15:04" time of day in UTC
+// taken from the hub clock.
+type Schedule struct {
+	At    string `json:"at"`
+	Scene string `json:"scene"`
+}
+
+type activation struct {
+	names []string
+	state byte
+}
+
+// sceneController expands group and scene names into device names and
+// collects activations requested from outside the polling loop until the
+// next round picks them up.
+type sceneController struct {
+	mu        sync.Mutex
+	groups    map[string][]string
+	scenes    map[string]map[string]byte
+	schedules []Schedule
+	atMillis  []int
+	lastTime  int
+	pending   []activation
+}
+
+func newSceneController(groups map[string][]string, scenes map[string]map[string]byte, schedules []Schedule) (*sceneController, error) {
+	scs := &sceneController{
+		groups:    groups,
+		scenes:    scenes,
+		schedules: schedules,
+		atMillis:  make([]int, len(schedules)),
+		lastTime:  -1,
+	}
+	for i, sched := range schedules {
+		if _, ok := scenes[sched.Scene]; !ok {
+			return nil, errors.New("schedule for unknown scene " + sched.Scene)
+		}
+		at, err := time.Parse("15:04", sched.At)
+		if err != nil {
+			return nil, err
+		}
+		scs.atMillis[i] = (at.Hour()*60 + at.Minute()) * 60 * 1000
+	}
+	return scs, nil
+}
+
+// expand resolves names that may refer to groups or scenes into the devices
+// to turn on and off, a later name wins over an earlier one for the same
+// device. Scenes only apply when state is on, turning a scene off means
+// nothing.
+func (scs *sceneController) expand(names []string, state byte) ([]string, []string) {
+	states := make(map[string]byte)
+	var order []string
+	put := func(name string, state byte) {
+		if _, ok := states[name]; !ok {
+			order = append(order, name)
+		}
+		states[name] = state
+	}
+	for _, name := range names {
+		if members, ok := scs.groups[name]; ok {
+			for _, member := range members {
+				put(member, state)
+			}
+		} else if scene, ok := scs.scenes[name]; ok {
+			if state == 1 {
+				for member, memberState := range scene {
+					put(member, memberState)
+				}
+			}
+		} else {
+			put(name, state)
+		}
+	}
+
+	var on, off []string
+	for _, name := range order {
+		if states[name] == 1 {
+			on = append(on, name)
+		} else {
+			off = append(off, name)
+		}
+	}
+	return on, off
+}
+
+func (scs *sceneController) activateGroup(name string, state byte) bool {
+	scs.mu.Lock()
+	defer scs.mu.Unlock()
+	if _, ok := scs.groups[name]; !ok {
+		return false
+	}
+	scs.pending = append(scs.pending, activation{names: []string{name}, state: state})
+	return true
+}
+
+func (scs *sceneController) activateScene(name string) bool {
+	scs.mu.Lock()
+	defer scs.mu.Unlock()
+	if _, ok := scs.scenes[name]; !ok {
+		return false
+	}
+	scs.pending = append(scs.pending, activation{names: []string{name}, state: 1})
+	return true
+}
+
+// tick queues the scenes whose schedule fell between the previous hub time
+// and now. Time going backwards or more than a day at once is a step of the
+// clock rather than time passing, it only moves lastTime on.
+func (scs *sceneController) tick(now int) {
+	scs.mu.Lock()
+	defer scs.mu.Unlock()
+	if now < 0 {
+		return
+	}
+	if scs.lastTime < 0 || now < scs.lastTime || now-scs.lastTime >= dayMillis {
+		scs.lastTime = now
+		return
+	}
+	dayStart := scs.lastTime - scs.lastTime%dayMillis
+	for i, sched := range scs.schedules {
+		next := dayStart + scs.atMillis[i]
+		if next <= scs.lastTime {
+			next += dayMillis
+		}
+		if next <= now {
+			scs.pending = append(scs.pending, activation{names: []string{sched.Scene}, state: 1})
+		}
+	}
+	scs.lastTime = now
+}
+
+// rebase is told of a jump of the hub clock, the next tick starts over from
+// the new time without firing what the jump stepped over.
+func (scs *sceneController) rebase(shift int) {
+	scs.mu.Lock()
+	defer scs.mu.Unlock()
+	if shift != 0 {
+		scs.lastTime = -1
+	}
+}
+
+func (scs *sceneController) drain() []activation {
+	scs.mu.Lock()
+	defer scs.mu.Unlock()
+	pending := scs.pending
+	scs.pending = nil
+	return pending
+}
+
+// applyTargets sends SETSTATUS for names, expanding groups and scenes, as
+// one batch appended to pcts.
+func applyTargets(pcts *Packets, database map[int]*Database, scenes *sceneController, names []string, state byte, newPacket packetFactory) {
+	on, off := scenes.expand(names, state)
+	setState(pcts, database, on, 1, newPacket)
+	setState(pcts, database, off, 0, newPacket)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSceneExpansion(t *testing.T) {
+	scenes, err := newSceneController(
+		map[string][]string{"living room lights": {"LAMP01", "LAMP02"}},
+		map[string]map[string]byte{"night": {"LAMP01": 0, "SOCKET01": 1}},
+		[]Schedule{{At: "23:00", Scene: "night"}},
+	)
+	assert.NoError(t, err)
+
+	on, off := scenes.expand([]string{"living room lights", "SOCKET02"}, 1)
+	assert.Equal(t, []string{"LAMP01", "LAMP02", "SOCKET02"}, on)
+	assert.Empty(t, off)
+
+	on, off = scenes.expand([]string{"living room lights", "night"}, 1)
+	assert.ElementsMatch(t, []string{"LAMP02", "SOCKET01"}, on)
+	assert.Equal(t, []string{"LAMP01"}, off)
+
+	database := map[int]*Database{
+		4: {Address: 4, DevName: "LAMP01", DevType: Lamp},
+		5: {Address: 5, DevName: "LAMP02", DevType: Lamp},
+	}
+	var pcts Packets
+	h, err := newHub(defaultConfig(), "", 1)
+	assert.NoError(t, err)
+	applyTargets(&pcts, database, scenes, []string{"living room lights"}, 1, h.newPacketAs)
+	assert.Len(t, pcts, 2)
+	assert.Equal(t, 3, h.serial.peek())
+}
+
+func TestSceneSchedule(t *testing.T) {
+	scenes, err := newSceneController(nil, map[string]map[string]byte{"night": {"LAMP01": 0}}, []Schedule{{At: "23:00", Scene: "night"}})
+	assert.NoError(t, err)
+
+	day := 10 * dayMillis
+	scenes.tick(day + 22*60*60*1000)
+	assert.Empty(t, scenes.drain())
+	scenes.tick(day + 22*60*60*1000 + 59*60*1000)
+	assert.Empty(t, scenes.drain())
+	scenes.tick(day + 23*60*60*1000)
+	assert.Equal(t, []activation{{names: []string{"night"}, state: 1}}, scenes.drain())
+	scenes.tick(day + 23*60*60*1000 + 1000)
+	assert.Empty(t, scenes.drain())
+
+	// a step of more than a day crosses every schedule, none of them fire
+	scenes.tick(day + 3*dayMillis + 12*60*60*1000)
+	assert.Empty(t, scenes.drain())
+	scenes.tick(day + 3*dayMillis + 23*60*60*1000)
+	assert.Equal(t, []activation{{names: []string{"night"}, state: 1}}, scenes.drain())
+
+	// nor do they when the clock reports a jump, here from the monotonic
+	// fallback at 22:00 to an epoch TICK at noon the next day
+	scenes.tick(day + 4*dayMillis + 22*60*60*1000)
+	scenes.rebase(14 * 60 * 60 * 1000)
+	scenes.tick(day + 5*dayMillis + 12*60*60*1000)
+	assert.Empty(t, scenes.drain())
+	scenes.tick(day + 5*dayMillis + 23*60*60*1000)
+	assert.Equal(t, []activation{{names: []string{"night"}, state: 1}}, scenes.drain())
+
+	_, err = newSceneController(nil, nil, []Schedule{{At: "07:00", Scene: "morning"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// pollScheduler decides which present devices get a GETSTATUS this round.
+// An interval of 0 polls a device type every round and a negative one never
+// does. A device whose status just changed is polled every fastInterval for
+// fastFor milliseconds, and at most maxBatch polls go out per round.
+type pollScheduler struct {
+	intervals    map[devType]int
+	fastInterval int
+	fastFor      int
+	jitter       int
+	maxBatch     int
+	rng          *rand.Rand
+	next         map[int]int
+	fastUntil    map[int]int
+}
+
+func newPollScheduler(cfg Config, seed int64) (*pollScheduler, error) {
+	ps := &pollScheduler{
+		intervals:    make(map[devType]int),
+		fastInterval: cfg.PollFastInterval,
+		fastFor:      cfg.PollFastFor,
+		jitter:       cfg.PollJitter,
+		maxBatch:     cfg.PollBatchLimit,
+		rng:          rand.New(rand.NewSource(seed)),
+		next:         make(map[int]int),
+		fastUntil:    make(map[int]int),
+	}
+	for name, interval := range cfg.PollIntervals {
+		found := false
+		for dt, dtName := range devTypeNames {
+			if dtName == name {
+				ps.intervals[dt] = interval
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown device type %s", name)
+		}
+	}
+	return ps, nil
+}
+
+func (ps *pollScheduler) interval(dev *Database, now int) (int, bool) {
+	interval, ok := ps.intervals[dev.DevType]
+	if !ok || interval < 0 {
+		return 0, false
+	}
+	if ps.fastUntil[dev.Address] > now && ps.fastInterval < interval {
+		interval = ps.fastInterval
+	}
+	return interval, true
+}
+
+// due returns the devices to poll now, longest overdue first, and schedules
+// their next poll.
+func (ps *pollScheduler) due(database map[int]*Database, now int) []int {
+	type candidate struct {
+		address int
+		at      int
+	}
+	var candidates []candidate
+	for address, dev := range database {
+		if !dev.IsPresent {
+			continue
+		}
+		if _, ok := ps.interval(dev, now); !ok {
+			continue
+		}
+		at, ok := ps.next[address]
+		if !ok || at <= now {
+			candidates = append(candidates, candidate{address: address, at: at})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].at != candidates[j].at {
+			return candidates[i].at < candidates[j].at
+		}
+		return candidates[i].address < candidates[j].address
+	})
+	if ps.maxBatch > 0 && len(candidates) > ps.maxBatch {
+		candidates = candidates[:ps.maxBatch]
+	}
+
+	addresses := make([]int, len(candidates))
+	for i, cand := range candidates {
+		addresses[i] = cand.address
+		interval, _ := ps.interval(database[cand.address], now)
+		if ps.jitter > 0 {
+			interval += ps.rng.Intn(ps.jitter + 1)
+		}
+		ps.next[cand.address] = now + interval
+	}
+	return addresses
+}
+
+// rebase moves the scheduled polls and fast periods by shift when the hub
+// clock jumps, so a step backwards does not hold polling until the clock
+// catches up again.
+func (ps *pollScheduler) rebase(shift int) {
+	for address := range ps.next {
+		ps.next[address] += shift
+	}
+	for address := range ps.fastUntil {
+		ps.fastUntil[address] += shift
+	}
+}
+
+// changed switches a device to the fast polling rate.
+func (ps *pollScheduler) changed(address, now int) {
+	if ps.fastFor <= 0 {
+		return
+	}
+	ps.fastUntil[address] = now + ps.fastFor
+	if next, ok := ps.next[address]; ok && next > now+ps.fastInterval {
+		ps.next[address] = now + ps.fastInterval
+	}
+}
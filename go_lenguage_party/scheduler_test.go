@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPollScheduler(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.PollIntervals = map[string]int{"Switch": 0, "Lamp": 1000}
+	cfg.PollFastInterval = 100
+	cfg.PollFastFor = 500
+	cfg.PollBatchLimit = 2
+	ps, err := newPollScheduler(cfg, 1)
+	assert.NoError(t, err)
+
+	database := map[int]*Database{
+		3: {Address: 3, DevType: Switch, IsPresent: true},
+		4: {Address: 4, DevType: Lamp, IsPresent: true},
+		5: {Address: 5, DevType: Lamp, IsPresent: true},
+		6: {Address: 6, DevType: Socket, IsPresent: true},
+		7: {Address: 7, DevType: Lamp, IsPresent: false},
+	}
+	assert.Equal(t, []int{3, 4}, ps.due(database, 0))
+	assert.Equal(t, []int{3, 5}, ps.due(database, 10))
+	assert.Equal(t, []int{3}, ps.due(database, 20))
+
+	ps.changed(4, 20)
+	assert.Equal(t, []int{3, 4}, ps.due(database, 120))
+	assert.Equal(t, []int{3}, ps.due(database, 150))
+	assert.Equal(t, []int{3, 4}, ps.due(database, 220))
+	assert.Equal(t, []int{3, 4}, ps.due(database, 900))
+	assert.Equal(t, []int{3}, ps.due(database, 950))
+	assert.Equal(t, []int{3, 5}, ps.due(database, 1010))
+
+	// the clock steps back by 10 s, polling goes on at the same pace
+	ps.rebase(-10000)
+	assert.Equal(t, []int{3}, ps.due(database, -8950))
+	assert.Equal(t, []int{3, 4}, ps.due(database, -8100))
+	ps.changed(5, -8090)
+	ps.rebase(-1000)
+	assert.Equal(t, []int{3, 5}, ps.due(database, -8990))
+	assert.Equal(t, []int{3, 5}, ps.due(database, -8890))
+
+	cfg.PollIntervals = map[string]int{"Toaster": 10}
+	_, err = newPollScheduler(cfg, 1)
+	assert.Error(t, err)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// serialAllocator hands out serials from 1 to max and wraps around. With a
+// path it reserves serials in blocks and records the end of the current
+// block there before using it, so a restarted hub resumes past every serial
+// it may have sent.
+type serialAllocator struct {
+	next     int
+	max      int
+	path     string
+	block    int
+	reserved int
+}
+
+func newSerialAllocator(max int, path string, block int) (*serialAllocator, error) {
+	if max <= 0 {
+		return nil, errors.New("serial max must be positive")
+	}
+	if block <= 0 {
+		block = 1
+	}
+	sa := &serialAllocator{next: 1, max: max, path: path, block: block}
+	if path == "" {
+		return sa, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		next, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, err
+		}
+		if next < 1 {
+			return nil, fmt.Errorf("serial file %s holds %d, serials start at 1", path, next)
+		}
+		sa.next = sa.wrap(next)
+	}
+	return sa, sa.reserve()
+}
+
+func (sa *serialAllocator) wrap(serial int) int {
+	if serial < 1 || serial > sa.max {
+		// % keeps the sign of serial-1, shift it back into 0..max-1
+		return ((serial-1)%sa.max+sa.max)%sa.max + 1
+	}
+	return serial
+}
+
+func (sa *serialAllocator) reserve() error {
+	sa.reserved = sa.next
+	if sa.path == "" {
+		return nil
+	}
+	end := sa.wrap(sa.next + sa.block)
+	tmp := sa.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(end)+"\n"), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sa.path)
+}
+
+func (sa *serialAllocator) peek() int {
+	return sa.next
+}
+
+func (sa *serialAllocator) allocate() int {
+	serial := sa.next
+	sa.next = sa.wrap(sa.next + 1)
+	if sa.path != "" && (sa.next-sa.reserved+sa.max)%sa.max >= sa.block {
+		if err := sa.reserve(); err != nil {
+			metrics.serialErrors.add(1)
+		}
+	}
+	return serial
+}
+
+// replayFilter remembers the last window serials seen from every device and
+// reports packets repeating one of them. WHOISHERE starts a device over,
+// it is what a restarted device sends first.
+type replayFilter struct {
+	window int
+	recent map[int][]int
+}
+
+func newReplayFilter(window int) *replayFilter {
+	return &replayFilter{window: window, recent: make(map[int][]int)}
+}
+
+func (rf *replayFilter) replayed(pct Packet) bool {
+	src, serial := pct.Payload.Src, pct.Payload.Serial
+	if rf.window <= 0 {
+		return false
+	}
+	if pct.Payload.Cmd == WHOISHERE {
+		rf.recent[src] = []int{serial}
+		return false
+	}
+	recent := rf.recent[src]
+	for _, seen := range recent {
+		if seen == serial {
+			return true
+		}
+	}
+	recent = append(recent, serial)
+	if len(recent) > rf.window {
+		recent = recent[len(recent)-rf.window:]
+	}
+	rf.recent[src] = recent
+	return false
+}
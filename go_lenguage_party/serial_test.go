@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSerialAllocatorWrapAround(t *testing.T) {
+	serial, err := newSerialAllocator(3, "", 0)
+	assert.NoError(t, err)
+	var got []int
+	for i := 0; i < 5; i++ {
+		got = append(got, serial.allocate())
+	}
+	assert.Equal(t, []int{1, 2, 3, 1, 2}, got)
+
+	for in, want := range map[int]int{0: 3, -1: 2, -3: 3, 4: 1, 7: 1} {
+		assert.Equal(t, want, serial.wrap(in), "wrap(%d)", in)
+	}
+}
+
+func TestSerialAllocatorPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "serial")
+	serial, err := newSerialAllocator(1000, path, 10)
+	assert.NoError(t, err)
+	last := 0
+	for i := 0; i < 25; i++ {
+		last = serial.allocate()
+	}
+
+	restarted, err := newSerialAllocator(1000, path, 10)
+	assert.NoError(t, err)
+	assert.Greater(t, restarted.allocate(), last)
+
+	for _, stored := range []string{"0\n", "-5\n"} {
+		assert.NoError(t, os.WriteFile(path, []byte(stored), 0o644))
+		_, err = newSerialAllocator(1000, path, 10)
+		assert.Error(t, err, stored)
+	}
+}
+
+func TestReplayFilter(t *testing.T) {
+	rf := newReplayFilter(2)
+	status := func(serial int) Packet {
+		return devicePacket(4, 1, serial, Lamp, STATUS, Value{Value: 1})
+	}
+	assert.False(t, rf.replayed(status(1)))
+	assert.False(t, rf.replayed(status(2)))
+	assert.True(t, rf.replayed(status(2)))
+	assert.False(t, rf.replayed(status(3)))
+	// 1 fell out of the window
+	assert.False(t, rf.replayed(status(1)))
+
+	assert.False(t, rf.replayed(devicePacket(4, OpenProtocol, 1, Lamp, WHOISHERE, Name{DevName: "LAMP01"})))
+	assert.False(t, rf.replayed(status(2)))
+}
@@ -0,0 +1,96 @@
+package main
+
+type triggerKey struct {
+	sensor  int
+	trigger Trigger
+}
+
+type triggerState struct {
+	since int
+	fired bool
+}
+
+// triggerEngine latches EnvSensor triggers: once fired a trigger stays quiet
+// until its reading moves back past the threshold by the hysteresis band,
+// and a condition has to hold for dwell milliseconds before firing.
+type triggerEngine struct {
+	hysteresis int
+	dwell      int
+	states     map[triggerKey]*triggerState
+}
+
+func newTriggerEngine(hysteresis, dwell int) *triggerEngine {
+	return &triggerEngine{
+		hysteresis: hysteresis,
+		dwell:      dwell,
+		states:     make(map[triggerKey]*triggerState),
+	}
+}
+
+// parseTriggerOp splits op into the state to set, the comparison direction
+// and the sensor the trigger watches.
+func parseTriggerOp(op byte) (byte, bool, sensorType) {
+	return op & 1, (op>>1)&1 == 1, sensorType(op >> 2)
+}
+
+func (te *triggerEngine) evaluate(sensor int, trigger Trigger, rds Readings, now int) bool {
+	_, greaterThen, st := parseTriggerOp(trigger.Op)
+	reading, ok := rds.get(st)
+	if !ok {
+		return false
+	}
+	key := triggerKey{sensor: sensor, trigger: trigger}
+	state, ok := te.states[key]
+	if !ok {
+		state = &triggerState{since: -1}
+		te.states[key] = state
+	}
+
+	var active, released bool
+	if greaterThen {
+		active = reading > trigger.Value
+		released = reading <= trigger.Value-te.hysteresis
+	} else {
+		active = reading < trigger.Value
+		released = reading >= trigger.Value+te.hysteresis
+	}
+
+	if state.fired {
+		if released {
+			state.fired = false
+			state.since = -1
+		}
+		return false
+	}
+	if !active {
+		state.since = -1
+		return false
+	}
+	if state.since < 0 {
+		state.since = now
+	}
+	if now-state.since < te.dwell {
+		return false
+	}
+	state.fired = true
+	return true
+}
+
+// rebase moves the start of every dwell under way by shift when the hub
+// clock jumps.
+func (te *triggerEngine) rebase(shift int) {
+	for _, state := range te.states {
+		if state.since >= 0 {
+			state.since += shift
+		}
+	}
+}
+
+func hasState(database map[int]*Database, name string, state byte) bool {
+	for _, dev := range database {
+		if dev.DevName == name {
+			return dev.StatusKnown && dev.Status == (state == 1)
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTriggerHysteresisAndDwell(t *testing.T) {
+	engine := newTriggerEngine(5, 100)
+	// turn LAMP01 on when the temperature gets above 30
+	trigger := Trigger{Op: 0b0011, Value: 30, Name: "LAMP01"}
+	temperature := func(value int) Readings {
+		return readingsFromValues(0b0001, []int{value})
+	}
+
+	assert.False(t, engine.evaluate(1, trigger, temperature(31), 0))
+	assert.False(t, engine.evaluate(1, trigger, temperature(32), 50))
+	assert.True(t, engine.evaluate(1, trigger, temperature(32), 100))
+	assert.False(t, engine.evaluate(1, trigger, temperature(33), 200))
+
+	// hovering inside the band doesn't re-arm the trigger
+	assert.False(t, engine.evaluate(1, trigger, temperature(28), 300))
+	assert.False(t, engine.evaluate(1, trigger, temperature(31), 400))
+	assert.False(t, engine.evaluate(1, trigger, temperature(31), 500))
+
+	assert.False(t, engine.evaluate(1, trigger, temperature(25), 600))
+	assert.False(t, engine.evaluate(1, trigger, temperature(31), 700))
+	assert.True(t, engine.evaluate(1, trigger, temperature(31), 800))
+}
+
+func TestHasState(t *testing.T) {
+	database := map[int]*Database{
+		5: {Address: 5, DevName: "LAMP01", DevType: Lamp},
+	}
+	assert.False(t, hasState(database, "LAMP01", 0))
+	database[5].StatusKnown = true
+	assert.True(t, hasState(database, "LAMP01", 0))
+	assert.False(t, hasState(database, "LAMP01", 1))
+}
@@ -0,0 +1,75 @@
+package main
+
+import "log"
+
+const (
+	RejectDestination   string = "wrong_destination"
+	RejectUnknownSource string = "unknown_source"
+	RejectDevType       string = "dev_type_mismatch"
+	RejectCommand       string = "unexpected_cmd"
+	RejectBody          string = "bad_body"
+)
+
+// bodyValid reports whether the decoded body is what a device of type dt
+// sends with c.
+func bodyValid(dt devType, c cmd, body CmdBodyBytes) bool {
+	switch c {
+	case WHOISHERE, IAMHERE:
+		switch dt {
+		case EnvSensor:
+			_, ok := body.(Sensors)
+			return ok
+		case Switch:
+			_, ok := body.(SwitchDevice)
+			return ok
+		case Lamp, Socket, Clock, SmartHub:
+			_, ok := body.(Name)
+			return ok
+		}
+	case STATUS:
+		switch dt {
+		case EnvSensor:
+			_, ok := body.(Sensor)
+			return ok
+		case Switch, Lamp, Socket:
+			value, ok := body.(Value)
+			return ok && value.Value <= 1
+		}
+	case TICK:
+		_, ok := body.(Timestamp)
+		return ok && dt == Clock
+	}
+	return false
+}
+
+// validate checks an inbound packet against the registry and returns why
+// it has to be dropped, or an empty string for a packet the handler can
+// trust.
+func (h *hub) validate(pct Packet) string {
+	pld := pct.Payload
+	if pld.Dst != h.address && pld.Dst != OpenProtocol {
+		return RejectDestination
+	}
+	switch pld.Cmd {
+	case WHOISHERE, IAMHERE, STATUS, TICK:
+	default:
+		return RejectCommand
+	}
+	dev, known := h.reg.devices[pld.Src]
+	announce := pld.Cmd == WHOISHERE || pld.Cmd == IAMHERE || pld.Cmd == TICK
+	if !known && !announce {
+		return RejectUnknownSource
+	}
+	if known && pld.Cmd != WHOISHERE && dev.DevType != pld.DevType {
+		return RejectDevType
+	}
+	if !bodyValid(pld.DevType, pld.Cmd, pld.CmdBody) {
+		return RejectBody
+	}
+	return ""
+}
+
+func (h *hub) reject(pct Packet, reason string) {
+	metrics.packetsRejected.add(1, "reason", reason)
+	log.Printf("dropped %s from %x: %s", cmdName(pct.Payload.Cmd), pct.Payload.Src, reason)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHubValidate(t *testing.T) {
+	h, err := newHub(defaultConfig(), "", 1)
+	assert.NoError(t, err)
+	h.requestTime[OpenProtocol] = []int{0}
+	h.handler(&Packets{devicePacket(4, 1, 1, Lamp, IAMHERE, Name{DevName: "LAMP01"})})
+
+	for _, tc := range []struct {
+		pct    Packet
+		reason string
+	}{
+		{devicePacket(4, 1, 2, Lamp, STATUS, Value{Value: 1}), ""},
+		{devicePacket(5, OpenProtocol, 1, Socket, WHOISHERE, Name{DevName: "SOCKET01"}), ""},
+		{devicePacket(6, OpenProtocol, 1, Clock, TICK, Timestamp{Timestamp: 100}), ""},
+		{devicePacket(4, 2, 2, Lamp, STATUS, Value{Value: 1}), RejectDestination},
+		{devicePacket(5, 1, 2, Socket, STATUS, Value{Value: 1}), RejectUnknownSource},
+		{devicePacket(4, 1, 2, Socket, STATUS, Value{Value: 1}), RejectDevType},
+		{devicePacket(4, 1, 2, Lamp, SETSTATUS, Value{Value: 1}), RejectCommand},
+		{devicePacket(4, 1, 2, Lamp, STATUS, Value{Value: 7}), RejectBody},
+		{devicePacket(4, 1, 2, Lamp, STATUS, Timestamp{Timestamp: 1}), RejectBody},
+		{devicePacket(5, 1, 1, Switch, IAMHERE, Name{DevName: "SWITCH01"}), RejectBody},
+	} {
+		assert.Equal(t, tc.reason, h.validate(tc.pct), "%+v", tc.pct.Payload)
+	}
+
+	// an unknown device's STATUS used to panic in the handler
+	assert.NotPanics(t, func() {
+		h.handler(&Packets{devicePacket(9, 1, 1, Lamp, STATUS, Value{Value: 1})})
+	})
+	assert.NotContains(t, h.reg.devices, 9)
+}
+
+func TestMalformedTickDoesNotPanic(t *testing.T) {
+	empty := devicePacket(6, OpenProtocol, 1, Clock, TICK, nil)
+	bad := devicePacket(6, OpenProtocol, 2, Clock, TICK, RawBody{Bytes: []byte{0x80}})
+	good := devicePacket(6, OpenProtocol, 3, Clock, TICK, Timestamp{Timestamp: 1200})
+	pcts := *packetsFromBytes(Packets{empty, bad, good}.toBytes())
+	if assert.Len(t, pcts, 3) {
+		assert.Nil(t, pcts[0].Payload.CmdBody)
+		assert.Nil(t, pcts[1].Payload.CmdBody)
+	}
+	assert.Equal(t, -1, findTime(pcts[:2]))
+	assert.Equal(t, 1200, findTime(pcts))
+
+	h, err := newHub(defaultConfig(), "", 1)
+	assert.NoError(t, err)
+	before := metrics.packetsRejected.get("reason", RejectBody)
+	assert.NotPanics(t, func() {
+		h.handler(&Packets{pcts[0], pcts[1]})
+	})
+	assert.Equal(t, before+2, metrics.packetsRejected.get("reason", RejectBody))
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Device is an in-process stand-in for a device on the network. Handle
+// answers one packet seen on the wire, Tick advances the device to network
+// time t and returns what it sends on its own.
+type Device interface {
+	Handle(pct Packet) []Packet
+	Tick(t int) []Packet
+}
+
+// virtualDevice is the part every device shares: addressing, serials,
+// WHOISHERE/IAMHERE and the packets queued for the next Tick. A Down
+// device neither answers nor sends.
+type virtualDevice struct {
+	Address int
+	Name    string
+	Type    devType
+	Down    bool
+	serial  int
+	wire    []byte
+	outbox  Packets
+	body    func() CmdBodyBytes
+}
+
+func (vd *virtualDevice) packet(dst int, c cmd, body CmdBodyBytes) Packet {
+	vd.serial++
+	pct := Packet{Payload: Payload{Src: vd.Address, Dst: dst, Serial: vd.serial, DevType: vd.Type, Cmd: c, CmdBody: body}}
+	vd.wire = pct.seal(vd.wire)
+	return pct
+}
+
+// Announce queues the WHOISHERE a device broadcasts when it powers up.
+func (vd *virtualDevice) Announce() {
+	vd.outbox = append(vd.outbox, vd.packet(OpenProtocol, WHOISHERE, vd.body()))
+}
+
+// handle answers discovery and reports whether the packet is left for the
+// concrete device.
+func (vd *virtualDevice) handle(pct Packet) ([]Packet, bool) {
+	pld := pct.Payload
+	if vd.Down || (pld.Dst != vd.Address && pld.Dst != OpenProtocol) || pld.Src == vd.Address {
+		return nil, false
+	}
+	if pld.Cmd == WHOISHERE {
+		return []Packet{vd.packet(OpenProtocol, IAMHERE, vd.body())}, false
+	}
+	return nil, pld.Dst == vd.Address
+}
+
+func (vd *virtualDevice) Tick(t int) []Packet {
+	if vd.Down {
+		vd.outbox = nil
+		return nil
+	}
+	out := vd.outbox
+	vd.outbox = nil
+	return out
+}
+
+// VirtualLamp also serves as the socket, they differ in devType only.
+type VirtualLamp struct {
+	virtualDevice
+	State byte
+}
+
+type VirtualSocket struct {
+	VirtualLamp
+}
+
+func newVirtualLamp(address int, name string) *VirtualLamp {
+	vl := &VirtualLamp{virtualDevice: virtualDevice{Address: address, Name: name, Type: Lamp}}
+	vl.body = func() CmdBodyBytes { return Name{DevName: vl.Name} }
+	return vl
+}
+
+func newVirtualSocket(address int, name string) *VirtualSocket {
+	vs := &VirtualSocket{VirtualLamp: *newVirtualLamp(address, name)}
+	vs.Type = Socket
+	vs.body = func() CmdBodyBytes { return Name{DevName: vs.Name} }
+	return vs
+}
+
+func (vl *VirtualLamp) Handle(pct Packet) []Packet {
+	replies, addressed := vl.handle(pct)
+	if !addressed {
+		return replies
+	}
+	switch pct.Payload.Cmd {
+	case SETSTATUS:
+		if value, ok := pct.Payload.CmdBody.(Value); ok {
+			vl.State = value.Value
+		}
+		fallthrough
+	case GETSTATUS:
+		return []Packet{vl.packet(pct.Payload.Src, STATUS, Value{Value: vl.State})}
+	}
+	return nil
+}
+
+type VirtualSwitch struct {
+	virtualDevice
+	State    byte
+	DevNames []string
+}
+
+func newVirtualSwitch(address int, name string, devNames ...string) *VirtualSwitch {
+	vs := &VirtualSwitch{virtualDevice: virtualDevice{Address: address, Name: name, Type: Switch}, DevNames: devNames}
+	vs.body = func() CmdBodyBytes {
+		return SwitchDevice{DevName: vs.Name, DevProps: DevProps{DevNames: vs.DevNames}}
+	}
+	return vs
+}
+
+// Flip moves the switch to state and queues the STATUS it broadcasts.
+func (vs *VirtualSwitch) Flip(state byte) {
+	vs.State = state
+	vs.outbox = append(vs.outbox, vs.packet(OpenProtocol, STATUS, Value{Value: state}))
+}
+
+func (vs *VirtualSwitch) Handle(pct Packet) []Packet {
+	replies, addressed := vs.handle(pct)
+	if addressed && pct.Payload.Cmd == GETSTATUS {
+		return []Packet{vs.packet(pct.Payload.Src, STATUS, Value{Value: vs.State})}
+	}
+	return replies
+}
+
+type VirtualEnvSensor struct {
+	virtualDevice
+	Sensors  byte
+	Triggers []Trigger
+	Readings [sensorTypes]int
+}
+
+func newVirtualEnvSensor(address int, name string, sensors byte, triggers ...Trigger) *VirtualEnvSensor {
+	ve := &VirtualEnvSensor{virtualDevice: virtualDevice{Address: address, Name: name, Type: EnvSensor}, Sensors: sensors, Triggers: triggers}
+	ve.body = func() CmdBodyBytes {
+		return Sensors{DevName: ve.Name, DevProps: EnvSensorProps{Sensors: ve.Sensors, Triggers: ve.Triggers}}
+	}
+	return ve
+}
+
+func (ve *VirtualEnvSensor) Set(st sensorType, value int) {
+	ve.Readings[st] = value
+}
+
+// values lists the readings of the enabled sensors, lowest bit first, the
+// order readingsFromValues expects.
+func (ve *VirtualEnvSensor) values() []int {
+	values := make([]int, 0, sensorTypes)
+	for i := 0; i < sensorTypes; i++ {
+		if ve.Sensors&(1<<i) != 0 {
+			values = append(values, ve.Readings[i])
+		}
+	}
+	return values
+}
+
+func (ve *VirtualEnvSensor) Handle(pct Packet) []Packet {
+	replies, addressed := ve.handle(pct)
+	if addressed && pct.Payload.Cmd == GETSTATUS {
+		return []Packet{ve.packet(pct.Payload.Src, STATUS, Sensor{Values: ve.values()})}
+	}
+	return replies
+}
+
+type VirtualClock struct {
+	virtualDevice
+}
+
+func newVirtualClock(address int, name string) *VirtualClock {
+	vc := &VirtualClock{virtualDevice: virtualDevice{Address: address, Name: name, Type: Clock}}
+	vc.body = func() CmdBodyBytes { return Name{DevName: vc.Name} }
+	return vc
+}
+
+func (vc *VirtualClock) Handle(pct Packet) []Packet {
+	replies, _ := vc.handle(pct)
+	return replies
+}
+
+// Tick broadcasts the network time after anything queued.
+func (vc *VirtualClock) Tick(t int) []Packet {
+	out := vc.virtualDevice.Tick(t)
+	if vc.Down {
+		return nil
+	}
+	return append(out, vc.packet(OpenProtocol, TICK, Timestamp{Timestamp: t}))
+}
+
+// VirtualNetwork carries the hub's batches to its devices in process. Each
+// round delivers the batch, moves the time on by Step and returns the
+// replies followed by what the devices send on their own.
+type VirtualNetwork struct {
+	Devices []Device
+	Time    int
+	Step    int
+}
+
+func newVirtualNetwork(start, step int, devices ...Device) *VirtualNetwork {
+	return &VirtualNetwork{Devices: devices, Time: start, Step: step}
+}
+
+func (vn *VirtualNetwork) Exchange(batch Packets) Packets {
+	replies := Packets{}
+	for _, pct := range batch {
+		for _, dev := range vn.Devices {
+			replies = append(replies, dev.Handle(pct)...)
+		}
+	}
+	vn.Time += vn.Step
+	for _, dev := range vn.Devices {
+		replies = append(replies, dev.Tick(vn.Time)...)
+	}
+	return replies
+}
+
+// transport lets the hub talk to the network in place of requestServer.
+func (vn *VirtualNetwork) transport(url, request string) ([]byte, int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(request)
+	if err != nil {
+		return nil, 400, err
+	}
+	replies := vn.Exchange(*packetsFromBytes(data))
+	return []byte(base64.RawURLEncoding.EncodeToString(replies.toBytes())), 200, nil
+}
+
+type virtualHome struct {
+	hub    *hub
+	net    *VirtualNetwork
+	lamp   *VirtualLamp
+	socket *VirtualSocket
+	sw     *VirtualSwitch
+	sensor *VirtualEnvSensor
+	clock  *VirtualClock
+}
+
+func newVirtualHome(t *testing.T) *virtualHome {
+	vh := &virtualHome{
+		lamp:   newVirtualLamp(0x04, "LAMP01"),
+		socket: newVirtualSocket(0x05, "SOCKET01"),
+		sw:     newVirtualSwitch(0x06, "SWITCH01", "SOCKET01"),
+		// temperature above 30 turns the lamp on
+		sensor: newVirtualEnvSensor(0x07, "SENSOR01", 0x01, Trigger{Op: 0x03, Value: 30, Name: "LAMP01"}),
+		clock:  newVirtualClock(0x08, "CLOCK01"),
+	}
+	vh.net = newVirtualNetwork(1000, 100, vh.lamp, vh.socket, vh.sw, vh.sensor, vh.clock)
+	h, err := newHub(defaultConfig(), "", 1)
+	assert.NoError(t, err)
+	h.transport = vh.net.transport
+	vh.hub = h
+	return vh
+}
+
+func TestVirtualLamp(t *testing.T) {
+	lamp := newVirtualLamp(0x04, "LAMP01")
+	hubPacket := func(dst int, c cmd, body CmdBodyBytes) Packet {
+		return devicePacket(1, dst, 1, SmartHub, c, body)
+	}
+
+	replies := lamp.Handle(hubPacket(OpenProtocol, WHOISHERE, Name{DevName: HubName}))
+	if assert.Len(t, replies, 1) {
+		assert.Equal(t, IAMHERE, replies[0].Payload.Cmd)
+		assert.Equal(t, Name{DevName: "LAMP01"}, replies[0].Payload.CmdBody)
+	}
+	replies = lamp.Handle(hubPacket(0x04, SETSTATUS, Value{Value: 1}))
+	if assert.Len(t, replies, 1) {
+		assert.Equal(t, STATUS, replies[0].Payload.Cmd)
+		assert.Equal(t, 1, replies[0].Payload.Dst)
+		assert.Equal(t, Value{Value: 1}, replies[0].Payload.CmdBody)
+	}
+	assert.Empty(t, lamp.Handle(hubPacket(0x05, SETSTATUS, Value{Value: 0})))
+	assert.Equal(t, byte(1), lamp.State)
+
+	lamp.Down = true
+	assert.Empty(t, lamp.Handle(hubPacket(0x04, GETSTATUS, nil)))
+}
+
+func TestVirtualEnvSensorValues(t *testing.T) {
+	sensor := newVirtualEnvSensor(0x07, "SENSOR01", 0x05)
+	sensor.Set(Temperature, 21)
+	sensor.Set(Humidity, 40)
+	sensor.Set(Illuminance, 300)
+	replies := sensor.Handle(devicePacket(1, 0x07, 1, SmartHub, GETSTATUS, nil))
+	if assert.Len(t, replies, 1) {
+		assert.Equal(t, Sensor{Values: []int{21, 300}}, replies[0].Payload.CmdBody)
+	}
+}
+
+func TestVirtualHomeDiscovery(t *testing.T) {
+	vh := newVirtualHome(t)
+	vh.hub.discover()
+
+	assert.Equal(t, Running, vh.hub.state)
+	assert.Equal(t, 1100, vh.hub.hubTime)
+	for _, address := range []int{0x04, 0x05, 0x06, 0x07, 0x08} {
+		if assert.Contains(t, vh.hub.reg.devices, address) {
+			assert.True(t, vh.hub.reg.devices[address].IsPresent)
+		}
+	}
+	assert.Equal(t, []string{"SOCKET01"}, vh.hub.reg.devices[0x06].ConnDevs)
+}
+
+func TestVirtualHomeSwitch(t *testing.T) {
+	vh := newVirtualHome(t)
+	vh.hub.discover()
+
+	vh.sw.Flip(1)
+	for i := 0; i < 3; i++ {
+		vh.hub.poll()
+	}
+	assert.Equal(t, byte(1), vh.socket.State)
+	assert.True(t, vh.hub.reg.devices[0x05].Status)
+	assert.Equal(t, byte(0), vh.lamp.State)
+}
+
+func TestVirtualHomeTrigger(t *testing.T) {
+	vh := newVirtualHome(t)
+	vh.sensor.Set(Temperature, 35)
+	vh.hub.discover()
+
+	for i := 0; i < 3; i++ {
+		vh.hub.poll()
+	}
+	assert.Equal(t, Reading{Value: 35, Present: true}, vh.hub.reg.devices[0x07].Readings.Temperature)
+	assert.Equal(t, byte(1), vh.lamp.State)
+	assert.Equal(t, byte(0), vh.socket.State)
+}
+
+func TestVirtualHomeTimeout(t *testing.T) {
+	vh := newVirtualHome(t)
+	vh.hub.discover()
+
+	vh.lamp.Down = true
+	vh.hub.queue.push(vh.hub.newPacket(0x04, GETSTATUS, nil), PriorityUser)
+	for i := 0; i < 5; i++ {
+		vh.hub.poll()
+	}
+	assert.False(t, vh.hub.reg.devices[0x04].IsPresent)
+	assert.True(t, vh.hub.reg.devices[0x05].IsPresent)
+}